@@ -0,0 +1,141 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var compatLock sync.Mutex
+
+// openCompat opens a database using the given driver wrapped in compatDriver.
+//
+// The queries in mauth (and some of MIS) are written for the MySQL driver, which executes statements
+// immediately even when they're sent with Query. Other drivers only execute the statement once the
+// returned rows are read, which mauth never does for INSERTs and UPDATEs.
+//
+// If rebind is true, the ? placeholders in queries are also replaced with the numbered $N placeholders
+// used by PostgreSQL.
+func openCompat(driverName, dsn string, rebind bool) (*sql.DB, error) {
+	compatLock.Lock()
+	defer compatLock.Unlock()
+	name := "mis-" + driverName
+	if !isRegistered(name) {
+		// Opening a database doesn't connect anywhere, it's only used to find the driver.
+		db, err := sql.Open(driverName, "")
+		if err != nil {
+			return nil, err
+		}
+		sql.Register(name, compatDriver{Driver: db.Driver(), rebind: rebind})
+		db.Close()
+	}
+	return sql.Open(name, dsn)
+}
+
+func isRegistered(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+type compatDriver struct {
+	driver.Driver
+	rebind bool
+}
+
+func (d compatDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return compatConn{Conn: conn, rebind: d.rebind}, nil
+}
+
+type compatConn struct {
+	driver.Conn
+	rebind bool
+}
+
+func (conn compatConn) Prepare(query string) (driver.Stmt, error) {
+	if conn.rebind {
+		query = rebindQuery(query)
+	}
+	stmt, err := conn.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return compatStmt{Stmt: stmt, returnsRows: returnsRows(query)}, nil
+}
+
+type compatStmt struct {
+	driver.Stmt
+	returnsRows bool
+}
+
+func (stmt compatStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !stmt.returnsRows {
+		_, err := stmt.Stmt.Exec(args)
+		if err != nil {
+			return nil, err
+		}
+		return emptyRows{}, nil
+	}
+	return stmt.Stmt.Query(args)
+}
+
+func returnsRows(query string) bool {
+	query = strings.ToUpper(strings.TrimSpace(query))
+	return strings.HasPrefix(query, "SELECT") || strings.HasPrefix(query, "WITH") || strings.HasPrefix(query, "PRAGMA")
+}
+
+// rebindQuery replaces ? placeholders outside of string literals with $1, $2 and so on.
+func rebindQuery(query string) string {
+	var buf strings.Builder
+	var quote rune
+	var n int
+	for _, char := range query {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"':
+			quote = char
+		case char == '?':
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(char)
+	}
+	return buf.String()
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
@@ -0,0 +1,36 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"testing"
+)
+
+func TestRebindQuery(t *testing.T) {
+	cases := map[string]string{
+		"SELECT 1;": "SELECT 1;",
+		"UPDATE users SET authtoken=? WHERE username=?;":            "UPDATE users SET authtoken=$1 WHERE username=$2;",
+		"SELECT * FROM images WHERE client LIKE '?' AND adder=?;":   "SELECT * FROM images WHERE client LIKE '?' AND adder=$1;",
+		"SELECT \"what?\" FROM images WHERE format=? AND hidden=?;": "SELECT \"what?\" FROM images WHERE format=$1 AND hidden=$2;",
+	}
+	for query, expected := range cases {
+		if received := rebindQuery(query); received != expected {
+			t.Errorf("Rebound query didn't match! Expected %s, but received %s", expected, received)
+		}
+	}
+}
@@ -26,19 +26,74 @@ import (
 
 // Configuration is a container struct for the configuration.
 type Configuration struct {
-	ImageLocation string    `json:"image-location"`
-	ImageTemplate string    `json:"image-template"`
-	DateFormat    string    `json:"date-format"`
-	TrustHeaders  bool      `json:"trust-headers"`
-	AllowSearch   bool      `json:"allow-search"`
-	RequireAuth   bool      `json:"require-authentication"`
-	IP            string    `json:"ip"`
-	Port          int       `json:"port"`
-	SQL           SQLConfig `json:"sql"`
+	ImageLocation      string        `json:"image-location"`
+	ImageTemplate      string        `json:"image-template"`
+	PublicURL          string        `json:"public-url"`
+	UnlistedNameLength int           `json:"unlisted-name-length"`
+	LinkSecret         string        `json:"link-secret"`
+	DateFormat         string        `json:"date-format"`
+	TrustHeaders       bool          `json:"trust-headers"`
+	AllowSearch        bool          `json:"allow-search"`
+	RequireAuth        bool          `json:"require-authentication"`
+	MaxUploadSize      int64         `json:"max-upload-size"`
+	UploadLocation     string        `json:"upload-location"`
+	UploadExpiry       int           `json:"upload-expiry"`
+	TrashRetention     int64         `json:"trash-retention"`
+	ThumbnailSizes     []int         `json:"thumbnail-sizes"`
+	StripMetadata      bool          `json:"strip-metadata"`
+	FormatMismatch     string        `json:"format-mismatch"`
+	AllowedTypes       []AllowedType `json:"allowed-types"`
+	SVG                string        `json:"svg"`
+	CacheControl       string        `json:"cache-control"`
+	CORS               CORSConfig    `json:"cors"`
+	Resize             ResizeConfig  `json:"resize"`
+	IP                 string        `json:"ip"`
+	Port               int           `json:"port"`
+	Storage            string        `json:"storage"`
+	S3                 S3Config      `json:"s3"`
+	SQL                SQLConfig     `json:"sql"`
+}
+
+// AllowedType is an entry in the list of image types that can be uploaded.
+type AllowedType struct {
+	// Type is the full MIME type, e.g. image/png.
+	Type string `json:"type"`
+	// MaxSize is the maximum size of images of this type in bytes. Zero means only max-upload-size applies.
+	MaxSize int64 `json:"max-size"`
+}
+
+// CORSConfig is the part of the config that controls which other websites can use the API from browsers.
+type CORSConfig struct {
+	// AllowedOrigins are the origins (e.g. https://example.com) that can make cross-origin requests. * allows all.
+	AllowedOrigins []string `json:"allowed-origins"`
+	// AllowedHeaders are the request headers that cross-origin requests can have. Empty means the headers used by MIS.
+	AllowedHeaders   []string `json:"allowed-headers"`
+	AllowCredentials bool     `json:"allow-credentials"`
+	// MaxAge is the number of seconds browsers can cache preflight responses.
+	MaxAge int `json:"max-age"`
+}
+
+// ResizeConfig is the part of the config that controls resizing images on the fly.
+type ResizeConfig struct {
+	// Sizes are the allowed sizes in the format WIDTHxHEIGHT, where zero means the dimension isn't limited.
+	Sizes         []string `json:"sizes"`
+	CacheLocation string   `json:"cache-location"`
+}
+
+// S3Config is the part of the config where details of the S3-compatible object storage are stored.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"access-key"`
+	SecretKey string `json:"secret-key"`
+	PathStyle bool   `json:"path-style"`
 }
 
 // SQLConfig is the part of the config where details of the SQL database are stored.
 type SQLConfig struct {
+	Driver         string      `json:"driver"`
 	Database       string      `json:"database"`
 	Connection     SQLConnInfo `json:"connection"`
 	Authentication SQLAuthInfo `json:"authentication"`
@@ -46,9 +101,10 @@ type SQLConfig struct {
 
 // SQLConnInfo contains the info about where to connect to.
 type SQLConnInfo struct {
-	Mode string `json:"mode"`
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
+	Mode    string `json:"mode"`
+	IP      string `json:"ip"`
+	Port    int    `json:"port"`
+	SSLMode string `json:"ssl-mode"`
 }
 
 // ToString turns a SQL connection info into a string for the DSN.
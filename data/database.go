@@ -20,6 +20,7 @@ package data
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -34,6 +35,95 @@ type ImageEntry struct {
 	Timestamp int64  `json:"timestamp,omitempty"`
 	ID        int    `json:"id,omitempty"`
 	Hidden    bool   `json:"hidden,omitempty"`
+	// Visibility is VisibilityPublic, VisibilityUnlisted or VisibilityPrivate. Hidden is true for all but public images.
+	Visibility string `json:"visibility,omitempty"`
+	Hash       string `json:"sha256,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+	// ExpiresAt is the unix timestamp after which the image is removed. Zero means never.
+	ExpiresAt int64 `json:"expires-at,omitempty"`
+	// MaxViews is the number of times the image can be viewed before it's removed. Zero means no limit.
+	MaxViews int `json:"max-views,omitempty"`
+	Views    int `json:"views,omitempty"`
+	// PasswordHash is the bcrypt hash of the password of the image, or empty if the image doesn't have a password.
+	PasswordHash string `json:"-"`
+	// Protected is true if the image has a password. It's only used in responses.
+	Protected bool `json:"password-protected,omitempty"`
+	// DeletedAt is the unix timestamp when the image was moved to the trash, or zero if it's not in the trash.
+	DeletedAt int64 `json:"deleted-at,omitempty"`
+}
+
+// The visibility levels of images.
+const (
+	// VisibilityPublic images are shown in search results.
+	VisibilityPublic = "public"
+	// VisibilityUnlisted images aren't shown in search results, but anyone who knows the name can view them.
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPrivate images can only be viewed by the uploader or with a signed link.
+	VisibilityPrivate = "private"
+)
+
+// ValidVisibility checks if the given string is a known visibility level.
+func ValidVisibility(visibility string) bool {
+	return visibility == VisibilityPublic || visibility == VisibilityUnlisted || visibility == VisibilityPrivate
+}
+
+// visibility returns the visibility of this image. Entries without a visibility are unlisted if they're hidden and
+// public otherwise.
+func (entry ImageEntry) visibility() string {
+	if len(entry.Visibility) > 0 {
+		return entry.Visibility
+	} else if entry.Hidden {
+		return VisibilityUnlisted
+	}
+	return VisibilityPublic
+}
+
+// Expired checks if the image has expired or has been viewed MaxViews times at the given time.
+func (entry ImageEntry) Expired(now time.Time) bool {
+	return (entry.ExpiresAt > 0 && now.Unix() >= entry.ExpiresAt) || (entry.MaxViews > 0 && entry.Views >= entry.MaxViews)
+}
+
+// FileName returns the name of the file in the ImageStore that contains this image.
+// Images with a hash are stored as deduplicated blobs, while older images are stored by name.
+func (entry ImageEntry) FileName() string {
+	if len(entry.Hash) > 0 {
+		return BlobName(entry.Hash)
+	}
+	return entry.ImageName + "." + entry.Format
+}
+
+// ContentType returns the MIME type of this image for the Content-Type header.
+func (entry ImageEntry) ContentType() string {
+	if len(entry.MimeType) == 0 {
+		// Very old images may not have a MIME type.
+		return "image/" + entry.Format
+	}
+	return "image/" + entry.MimeType
+}
+
+// ThumbnailName returns the name of the file in the ImageStore that contains the thumbnail of this image with the
+// given size. Thumbnails are stored next to the blob, so images stored by name don't have thumbnails.
+func (entry ImageEntry) ThumbnailName(size int) string {
+	if len(entry.Hash) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%[1]s-%[2]d.%[3]s", BlobName(entry.Hash), size, entry.ThumbnailFormat())
+}
+
+// ThumbnailFormat returns the format the thumbnails of this image are stored in.
+// Photos are stored as JPEG and everything else as PNG to keep transparency.
+func (entry ImageEntry) ThumbnailFormat() string {
+	if entry.MimeType == "jpeg" {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// BlobName returns the name of the file in the ImageStore that contains the image with the given SHA-256 hash.
+func BlobName(hash string) string {
+	return "blobs/" + hash[:2] + "/" + hash
 }
 
 // MISDatabase is the interface for MIS databases.
@@ -44,27 +134,95 @@ type MISDatabase interface {
 	Unload() error
 	GetInternalDB() *sql.DB
 
-	// Insert the given image name and marks it owned by the given username.
-	Insert(imageName, imageFormat, mimeType, adder, adderip, client string, hidden bool) error
-	// Update the image with the given name giving it the given information.
-	Update(imageName, imageFormat, mimeType, adderip, client string, hidden bool) error
+	// Insert the given image. The timestamp is set to the current time and the ID is generated automatically.
+	Insert(image ImageEntry) error
+	// Update the image with the same name as the given entry. The owner and ID are not changed.
+	Update(image ImageEntry) error
 
 	// Remove the image with the given name.
 	Remove(imageName string) error
-	// SetHidden changes the hidden status of the image.
-	SetHidden(imageName string, hidden bool) error
+	// Trash moves the image with the given name to the trash. Images in the trash are ignored by Query and Search.
+	Trash(imageName string) error
+	// Restore moves the image with the given name out of the trash.
+	Restore(imageName string) error
+	// SetVisibility changes the visibility of the image. All but public images are hidden from search.
+	SetVisibility(imageName, visibility string) error
+	// AddView increments the view count of the image. False is returned if the image has expired or has no views left.
+	AddView(imageName string) (bool, error)
 
 	// Query for basic details of the given image.
 	Query(imageName string) (ImageEntry, error)
+	// QueryDeleted queries for basic details of the given image in the trash.
+	QueryDeleted(imageName string) (ImageEntry, error)
+	// QueryTrash finds the images in the trash. If adder isn't empty, only images uploaded by that user are returned.
+	// If deletedBefore isn't zero, only images moved to the trash before that unix timestamp are returned.
+	QueryTrash(adder string, deletedBefore int64) ([]ImageEntry, error)
 	// GetOwner gets the owner of the image with the given name.
 	GetOwner(imageName string) string
 	// Search the database with the given arguments.
 	Search(format, adder, client string, timeMin, timeMax int64, showHidden bool) ([]ImageEntry, error)
+	// QueryExpired finds the images that have expired or have no views left at the given unix timestamp. Images in
+	// the trash aren't included, as they're removed when the trash is emptied.
+	QueryExpired(now int64) ([]ImageEntry, error)
+
+	// AddBlobReference increments the reference count of the blob with the given hash, creating it if necessary.
+	AddBlobReference(hash string, size int64) error
+	// RemoveBlobReference decrements the reference count of the blob with the given hash and returns the
+	// number of references left. The blob is removed from the database when there are no references left.
+	RemoveBlobReference(hash string) (int, error)
+}
+
+// imageColumns are the columns of the images table in the order scanImage expects them.
+const imageColumns = "imgname, format, mimetype, adder, adderip, client, timestamp, hidden, id, hash, width, height, bytes, visibility, expires, maxviews, views, password, deleted_at"
+
+type scannable interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanImage reads an ImageEntry from a row containing the columns in imageColumns.
+func scanImage(row scannable) (ImageEntry, error) {
+	var entry ImageEntry
+	var hid int
+	var hash, visibility, password sql.NullString
+	var width, height, bytes, expires, maxViews, deletedAt sql.NullInt64
+	err := row.Scan(&entry.ImageName, &entry.Format, &entry.MimeType, &entry.Adder, &entry.AdderIP, &entry.Client,
+		&entry.Timestamp, &hid, &entry.ID, &hash, &width, &height, &bytes, &visibility, &expires, &maxViews, &entry.Views, &password, &deletedAt)
+	entry.Hidden = hid != 0
+	entry.Visibility = visibility.String
+	entry.Visibility = entry.visibility()
+	entry.Hash = hash.String
+	entry.Width = int(width.Int64)
+	entry.Height = int(height.Int64)
+	entry.Bytes = bytes.Int64
+	entry.ExpiresAt = expires.Int64
+	entry.MaxViews = int(maxViews.Int64)
+	entry.PasswordHash = password.String
+	entry.Protected = len(entry.PasswordHash) > 0
+	entry.DeletedAt = deletedAt.Int64
+	return entry, err
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// nullString converts empty strings to NULL.
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: len(value) > 0}
+}
+
+// nullInt converts zeroes (i.e. unknown values) to NULL.
+func nullInt(value int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: value, Valid: value != 0}
 }
 
 type mis struct {
-	conf SQLConfig
-	db   *sql.DB
+	conf    SQLConfig
+	dialect *dialect
+	db      *sql.DB
 }
 
 // CreateDatabase creates an instance of MISDatabase
@@ -78,7 +236,11 @@ func (data *mis) GetInternalDB() *sql.DB {
 
 func (data *mis) Load() error {
 	var err error
-	data.db, err = sql.Open("mysql", fmt.Sprintf("%[1]s@%[2]s/%[3]s", data.conf.Authentication.ToString(), data.conf.Connection.ToString(), data.conf.Database))
+	data.dialect, err = getDialect(data.conf.Driver)
+	if err != nil {
+		return err
+	}
+	data.db, err = data.dialect.open(data.conf)
 
 	if err != nil {
 		return err
@@ -86,20 +248,17 @@ func (data *mis) Load() error {
 		return fmt.Errorf("Failed to open SQL connection!")
 	}
 
-	_, err = data.db.Exec("CREATE TABLE IF NOT EXISTS images (" +
-		"imgname VARCHAR(32) PRIMARY KEY," +
-		"format VARCHAR(16)," +
-		"mimetype VARCHAR(16)," +
-		"adder VARCHAR(16) NOT NULL," +
-		"adderip VARCHAR(64) NOT NULL," +
-		"client VARCHAR(64) NOT NULL," +
-		"timestamp BIGINT NOT NULL," +
-		"hidden TINYINT(1) NOT NULL," +
-		"id MEDIUMINT UNIQUE KEY AUTO_INCREMENT" +
-		");")
+	err = data.upgrade()
 	if err != nil {
 		return err
 	}
+	if len(data.dialect.usersTable) > 0 {
+		// Create the mauth users table here, as the DDL in mauth only works on MySQL.
+		_, err = data.db.Exec(data.dialect.usersTable)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -127,99 +286,51 @@ func (data *mis) GetOwner(imageName string) string {
 }
 
 func (data *mis) Search(format, adder, client string, timeMin, timeMax int64, showHidden bool) ([]ImageEntry, error) {
-	var result *sql.Rows
-	var err error
-	if len(format) == 0 {
-		if len(adder) == 0 {
-			if len(client) == 0 {
-				if timeMin <= 0 || timeMax <= 0 {
-					result, err = data.db.Query("SELECT * FROM images;")
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE timestamp BETWEEN ? AND ?;", timeMin, timeMax)
-				}
-			} else {
-				client = "%" + client + "%"
-				if timeMin <= 0 || timeMax <= 0 {
-					result, err = data.db.Query("SELECT * FROM images WHERE (client LIKE ?);", client)
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE (client LIKE ?) AND (timestamp BETWEEN ? AND ?);", client, timeMin, timeMax)
-				}
-			}
-		} else {
-			adder = "%" + adder + "%"
-			if len(client) == 0 {
-				if timeMin <= 0 || timeMax <= 0 {
-					result, err = data.db.Query("SELECT * FROM images WHERE (adder LIKE ?);", adder)
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE (adder LIKE ?) AND (timestamp BETWEEN ? AND ?);", adder, timeMin, timeMax)
-				}
-			} else {
-				client = "%" + client + "%"
-				if timeMin <= 0 || timeMax <= 0 {
-					result, err = data.db.Query("SELECT * FROM images WHERE (adder LIKE ?) AND (client LIKE ?);", adder, client)
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE (adder LIKE ?) AND (client LIKE ?) AND (timestamp BETWEEN ? AND ?);", adder, client, timeMin, timeMax)
-				}
-			}
-		}
+	var conditions []string
+	var args []interface{}
+	if len(format) > 0 {
+		conditions = append(conditions, "format=?")
+		args = append(args, format)
+	}
+	if len(adder) > 0 {
+		conditions = append(conditions, "(adder "+data.dialect.like+" ?)")
+		args = append(args, "%"+adder+"%")
+	}
+	if len(client) > 0 {
+		conditions = append(conditions, "(client "+data.dialect.like+" ?)")
+		args = append(args, "%"+client+"%")
+	}
+	if timeMin > 0 && timeMax > 0 {
+		conditions = append(conditions, "(timestamp BETWEEN ? AND ?)")
+		args = append(args, timeMin, timeMax)
+	}
+	conditions = append(conditions, "deleted_at IS NULL")
+	if !showHidden {
+		conditions = append(conditions, "hidden=0")
 	} else {
-		if len(adder) == 0 {
-			if len(client) == 0 {
-				if timeMin == 0 || timeMax == 0 {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=?;", format)
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=? AND (timestamp BETWEEN ? AND ?);", format, timeMin, timeMax)
-				}
-			} else {
-				client = "%" + client + "%"
-				if timeMin == 0 || timeMax == 0 {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=? AND (client LIKE ?);", format, client)
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=? AND (client LIKE ?) AND (timestamp BETWEEN ? AND ?);", format, client, timeMin, timeMax)
-				}
-			}
-		} else {
-			adder = "%" + adder + "%"
-			if len(client) == 0 {
-				if timeMin == 0 || timeMax == 0 {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=? AND (adder LIKE ?);", format, adder)
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=? AND (adder LIKE ?) AND (timestamp BETWEEN ? AND ?);", format, adder, timeMin, timeMax)
-				}
-			} else {
-				client = "%" + client + "%"
-				if timeMin == 0 || timeMax == 0 {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=? AND (adder LIKE ?) AND (client LIKE ?);", format, adder, client)
-				} else {
-					result, err = data.db.Query("SELECT * FROM images WHERE format=? AND (adder LIKE ?) AND (client LIKE ?) AND (timestamp BETWEEN ? AND ?);", format, adder, client, timeMin, timeMax)
-				}
-			}
-		}
+		// The adder condition is a substring match, so hidden images of other users must be excluded separately.
+		conditions = append(conditions, "(hidden=0 OR adder=?)")
+		args = append(args, adder)
 	}
-	defer result.Close()
+
+	query := "SELECT " + imageColumns + " FROM images WHERE " + strings.Join(conditions, " AND ")
 	var results []ImageEntry
+	result, err := data.db.Query(query+";", args...)
 	if err != nil {
 		return results, err
 	}
+	defer result.Close()
 	for result.Next() {
 		if result.Err() != nil {
 			continue
 		}
-		var imageName, format, mimeType, adder, adderip, client string
-		var timestamp int64
-		var id, hid int
-
-		err = result.Scan(&imageName, &format, &mimeType, &adder, &adderip, &client, &timestamp, &hid, &id)
-		if err != nil || (!showHidden && hid != 0) {
+		entry, err := scanImage(result)
+		if err != nil {
 			continue
 		}
-
-		var hidden = false
-		if hid != 0 {
-			hidden = true
-		}
-
-		results = append(results, ImageEntry{ImageName: imageName, Format: format, MimeType: mimeType, Adder: adder, Client: client, Timestamp: timestamp, ID: id, Hidden: hidden})
+		// The IP of the uploader is not included in search results.
+		entry.AdderIP = ""
+		results = append(results, entry)
 	}
 	return results, nil
 }
@@ -229,41 +340,59 @@ func (data *mis) Remove(imageName string) error {
 	return err
 }
 
-func (data *mis) SetHidden(imageName string, hidden bool) error {
-	var hid int
-	if hidden {
-		hid = 1
-	} else {
-		hid = 0
-	}
-	_, err := data.db.Exec("UPDATE images SET hidden=? WHERE imgname=?", hid, imageName)
+func (data *mis) Trash(imageName string) error {
+	_, err := data.db.Exec("UPDATE images SET deleted_at=? WHERE imgname=?", time.Now().Unix(), imageName)
 	return err
 }
 
-func (data *mis) Insert(imageName, imageFormat, mimeType, adder, adderip, client string, hidden bool) error {
-	var hid int
-	if hidden {
-		hid = 1
-	} else {
-		hid = 0
-	}
-	_, err := data.db.Exec("INSERT INTO images (imgname, format, mimetype, adder, adderip, client, timestamp, hidden) VALUES (?, ?, ?, ?, ?, ?, ?, ?);", imageName, imageFormat, mimeType, adder, adderip, client, time.Now().Unix(), hid)
+func (data *mis) Restore(imageName string) error {
+	_, err := data.db.Exec("UPDATE images SET deleted_at=NULL WHERE imgname=?", imageName)
 	return err
 }
 
-func (data *mis) Update(imageName, imageFormat, mimeType, adderip, client string, hidden bool) error {
-	var hid int
-	if hidden {
-		hid = 1
-	} else {
-		hid = 0
+func (data *mis) SetVisibility(imageName, visibility string) error {
+	_, err := data.db.Exec("UPDATE images SET hidden=?, visibility=? WHERE imgname=?",
+		boolToInt(visibility != VisibilityPublic), visibility, imageName)
+	return err
+}
+
+func (data *mis) AddView(imageName string) (bool, error) {
+	res, err := data.db.Exec("UPDATE images SET views=views+1 WHERE imgname=? AND (maxviews IS NULL OR views<maxviews) AND (expires IS NULL OR expires>?)",
+		imageName, time.Now().Unix())
+	if err != nil {
+		return false, err
 	}
-	_, err := data.db.Exec("UPDATE images SET format=?,mimetype=?,adderip=?,client=?,timestamp=?,hidden=? WHERE imgname=?", imageFormat, mimeType, adderip, client, time.Now().Unix(), hid, imageName)
+	rows, err := res.RowsAffected()
+	return rows > 0, err
+}
+
+func (data *mis) Insert(image ImageEntry) error {
+	visibility := image.visibility()
+	_, err := data.db.Exec("INSERT INTO images (imgname, format, mimetype, adder, adderip, client, timestamp, hidden, hash, width, height, bytes, visibility, expires, maxviews, views, password) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?);",
+		image.ImageName, image.Format, image.MimeType, image.Adder, image.AdderIP, image.Client, time.Now().Unix(), boolToInt(visibility != VisibilityPublic), nullString(image.Hash),
+		nullInt(int64(image.Width)), nullInt(int64(image.Height)), nullInt(image.Bytes), visibility, nullInt(image.ExpiresAt), nullInt(int64(image.MaxViews)), nullString(image.PasswordHash))
+	return err
+}
+
+func (data *mis) Update(image ImageEntry) error {
+	visibility := image.visibility()
+	_, err := data.db.Exec("UPDATE images SET format=?,mimetype=?,adderip=?,client=?,timestamp=?,hidden=?,hash=?,width=?,height=?,bytes=?,visibility=?,expires=?,maxviews=?,views=0,password=?,deleted_at=NULL WHERE imgname=?",
+		image.Format, image.MimeType, image.AdderIP, image.Client, time.Now().Unix(), boolToInt(visibility != VisibilityPublic), nullString(image.Hash),
+		nullInt(int64(image.Width)), nullInt(int64(image.Height)), nullInt(image.Bytes), visibility, nullInt(image.ExpiresAt), nullInt(int64(image.MaxViews)), nullString(image.PasswordHash), image.ImageName)
 	return err
 }
 
 func (data *mis) Query(imageName string) (ImageEntry, error) {
-	result, err := data.db.Query("SELECT format, mimetype, adder, adderip, client, timestamp, id, hidden FROM images WHERE imgname=?", imageName)
+	return data.queryOne("SELECT "+imageColumns+" FROM images WHERE imgname=? AND deleted_at IS NULL", imageName)
+}
+
+func (data *mis) QueryDeleted(imageName string) (ImageEntry, error) {
+	return data.queryOne("SELECT "+imageColumns+" FROM images WHERE imgname=? AND deleted_at IS NOT NULL", imageName)
+}
+
+// queryOne runs the given query and reads the first image in the result.
+func (data *mis) queryOne(query string, args ...interface{}) (ImageEntry, error) {
+	result, err := data.db.Query(query, args...)
 	if err != nil {
 		return ImageEntry{}, err
 	}
@@ -272,24 +401,96 @@ func (data *mis) Query(imageName string) (ImageEntry, error) {
 		if result.Err() != nil {
 			return ImageEntry{}, result.Err()
 		}
-		var format, mimeType, adder, adderip, client string
-		var timestamp int64
-		var id, hid int
-		err = result.Scan(&format, &mimeType, &adder, &adderip, &client, &timestamp, &id, &hid)
-
-		var hidden bool
-		if hid == 0 {
-			hidden = false
-		} else {
-			hidden = true
-		}
-
+		entry, err := scanImage(result)
 		if err != nil {
 			return ImageEntry{}, err
-		} else if len(adder) == 0 || len(adderip) == 0 || len(client) == 0 || timestamp < 1 || id < 1 {
-			return ImageEntry{ImageName: imageName, Format: format, MimeType: mimeType, Adder: adder, AdderIP: adderip, Client: client, Timestamp: timestamp, ID: id, Hidden: hidden}, fmt.Errorf("Invalid data")
+		} else if len(entry.Adder) == 0 || len(entry.AdderIP) == 0 || len(entry.Client) == 0 || entry.Timestamp < 1 || entry.ID < 1 {
+			return entry, fmt.Errorf("Invalid data")
 		}
-		return ImageEntry{ImageName: imageName, Format: format, MimeType: mimeType, Adder: adder, AdderIP: adderip, Client: client, Timestamp: timestamp, ID: id, Hidden: hidden}, nil
+		return entry, nil
 	}
 	return ImageEntry{}, fmt.Errorf("No data found")
 }
+
+func (data *mis) QueryExpired(now int64) ([]ImageEntry, error) {
+	return data.queryList("SELECT "+imageColumns+" FROM images WHERE deleted_at IS NULL AND "+
+		"((expires IS NOT NULL AND expires<=?) OR (maxviews IS NOT NULL AND views>=maxviews))", now)
+}
+
+func (data *mis) QueryTrash(adder string, deletedBefore int64) ([]ImageEntry, error) {
+	query := "SELECT " + imageColumns + " FROM images WHERE deleted_at IS NOT NULL"
+	var args []interface{}
+	if len(adder) > 0 {
+		query += " AND adder=?"
+		args = append(args, adder)
+	}
+	if deletedBefore > 0 {
+		query += " AND deleted_at<?"
+		args = append(args, deletedBefore)
+	}
+	return data.queryList(query+" ORDER BY deleted_at", args...)
+}
+
+// queryList runs the given query and reads all the images in the result.
+func (data *mis) queryList(query string, args ...interface{}) ([]ImageEntry, error) {
+	result, err := data.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	var images []ImageEntry
+	for result.Next() {
+		entry, err := scanImage(result)
+		if err != nil {
+			return images, err
+		}
+		images = append(images, entry)
+	}
+	return images, result.Err()
+}
+
+func (data *mis) AddBlobReference(hash string, size int64) error {
+	tx, err := data.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE blobs SET refcount=refcount+1 WHERE hash=?", hash)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		_, err = tx.Exec("INSERT INTO blobs (hash, refcount, size) VALUES (?, 1, ?)", hash, size)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (data *mis) RemoveBlobReference(hash string) (int, error) {
+	tx, err := data.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE blobs SET refcount=refcount-1 WHERE hash=?", hash)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	var refcount int
+	err = tx.QueryRow("SELECT refcount FROM blobs WHERE hash=?", hash).Scan(&refcount)
+	if err == sql.ErrNoRows {
+		// The blob didn't exist in the first place.
+		refcount, err = 0, nil
+	} else if err == nil && refcount <= 0 {
+		refcount = 0
+		_, err = tx.Exec("DELETE FROM blobs WHERE hash=?", hash)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return refcount, tx.Commit()
+}
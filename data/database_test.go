@@ -0,0 +1,269 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestDatabase creates a SQLite database in a temporary directory.
+func loadTestDatabase(t *testing.T) (MISDatabase, func()) {
+	dir, err := ioutil.TempDir("", "mis-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	db := CreateDatabase(SQLConfig{Driver: "sqlite3", Database: filepath.Join(dir, "mis.db")})
+	err = db.Load()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to load database: %s", err)
+	}
+	return db, func() {
+		db.Unload()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInsertQuery(t *testing.T) {
+	db, cleanup := loadTestDatabase(t)
+	defer cleanup()
+
+	entry := ImageEntry{
+		ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", AdderIP: "fakeIP", Client: "fakeClient",
+		Hash: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", Width: 640, Height: 480, Bytes: 12345,
+		Visibility: VisibilityPublic, PasswordHash: "fakePasswordHash", Protected: true,
+	}
+	err := db.Insert(entry)
+	if err != nil {
+		t.Fatalf("Failed to insert image: %s", err)
+	}
+	received, err := db.Query("fakeImage")
+	if err != nil {
+		t.Fatalf("Failed to query image: %s", err)
+	}
+	entry.Timestamp, entry.ID = received.Timestamp, received.ID
+	if received != entry {
+		t.Errorf("Queried image didn't match! Expected %+v, but received %+v", entry, received)
+	}
+
+	// Images without a hash or dimensions are stored with NULLs.
+	err = db.Update(ImageEntry{ImageName: "fakeImage", Format: "gif", MimeType: "gif", AdderIP: "fakeIP", Client: "fakeClient"})
+	if err != nil {
+		t.Fatalf("Failed to update image: %s", err)
+	}
+	results, err := db.Search("gif", "", "", 0, 0, false)
+	if err != nil {
+		t.Fatalf("Failed to search: %s", err)
+	} else if len(results) != 1 {
+		t.Fatalf("Expected 1 search result, but received %d", len(results))
+	} else if results[0].Hash != "" || results[0].Width != 0 || results[0].Bytes != 0 {
+		t.Errorf("Updated image still has old file details: %+v", results[0])
+	}
+}
+
+func TestVisibility(t *testing.T) {
+	db, cleanup := loadTestDatabase(t)
+	defer cleanup()
+
+	images := []ImageEntry{
+		{ImageName: "public", Adder: "fakeUser", Visibility: VisibilityPublic},
+		// Hidden images without a visibility are unlisted.
+		{ImageName: "unlisted", Adder: "fakeUser", Hidden: true},
+		{ImageName: "private", Adder: "fakeUser", Visibility: VisibilityPrivate},
+		{ImageName: "otherPrivate", Adder: "fakeUser2", Visibility: VisibilityPrivate},
+	}
+	for _, image := range images {
+		image.Format, image.MimeType, image.AdderIP, image.Client = "png", "png", "fakeIP", "fakeClient"
+		err := db.Insert(image)
+		if err != nil {
+			t.Fatalf("Failed to insert image: %s", err)
+		}
+	}
+	received, _ := db.Query("unlisted")
+	if received.Visibility != VisibilityUnlisted || !received.Hidden {
+		t.Errorf("Hidden image wasn't unlisted: %+v", received)
+	}
+
+	search := func(showHidden bool, expected ...string) {
+		results, err := db.Search("", "fakeUser", "", 0, 0, showHidden)
+		if err != nil {
+			t.Fatalf("Failed to search: %s", err)
+		}
+		var names []string
+		for _, result := range results {
+			names = append(names, result.ImageName)
+		}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("Search results didn't match! Expected %v, but received %v", expected, names)
+		}
+	}
+	search(false, "public")
+	// The adder search matches fakeUser2 too, but their hidden images must not be included.
+	search(true, "public", "unlisted", "private")
+
+	err := db.SetVisibility("private", VisibilityPublic)
+	if err != nil {
+		t.Fatalf("Failed to change visibility: %s", err)
+	}
+	search(false, "public", "private")
+}
+
+func TestExpiry(t *testing.T) {
+	db, cleanup := loadTestDatabase(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	images := []ImageEntry{
+		{ImageName: "permanent"},
+		{ImageName: "expired", ExpiresAt: now - 10},
+		{ImageName: "expiring", ExpiresAt: now + 3600},
+		{ImageName: "viewOnce", MaxViews: 1},
+	}
+	for _, image := range images {
+		image.Format, image.MimeType, image.Adder, image.AdderIP, image.Client = "png", "png", "fakeUser", "fakeIP", "fakeClient"
+		err := db.Insert(image)
+		if err != nil {
+			t.Fatalf("Failed to insert image: %s", err)
+		}
+	}
+	expired := func(expected ...string) {
+		results, err := db.QueryExpired(now)
+		if err != nil {
+			t.Fatalf("Failed to query expired images: %s", err)
+		}
+		var names []string
+		for _, result := range results {
+			names = append(names, result.ImageName)
+		}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expired images didn't match! Expected %v, but received %v", expected, names)
+		}
+	}
+	expired("expired")
+
+	for i, expected := range []bool{true, false} {
+		ok, err := db.AddView("viewOnce")
+		if err != nil {
+			t.Fatalf("Failed to add view: %s", err)
+		} else if ok != expected {
+			t.Errorf("View #%d returned %v, expected %v", i+1, ok, expected)
+		}
+	}
+	if ok, _ := db.AddView("expired"); ok {
+		t.Errorf("Viewing an expired image succeeded")
+	}
+	received, _ := db.Query("viewOnce")
+	if received.Views != 1 || !received.Expired(time.Now()) {
+		t.Errorf("Image with no views left wasn't expired: %+v", received)
+	}
+	expired("expired", "viewOnce")
+
+	// Replacing an image resets the view count.
+	err := db.Update(ImageEntry{ImageName: "viewOnce", Format: "png", MimeType: "png", AdderIP: "fakeIP", Client: "fakeClient", MaxViews: 1})
+	if err != nil {
+		t.Fatalf("Failed to update image: %s", err)
+	}
+	expired("expired")
+
+	// Images in the trash are only removed after the retention period, so that they can be restored.
+	err = db.Trash("expired")
+	if err != nil {
+		t.Fatalf("Failed to move image to the trash: %s", err)
+	}
+	expired()
+}
+
+func TestTrash(t *testing.T) {
+	db, cleanup := loadTestDatabase(t)
+	defer cleanup()
+
+	for _, name := range []string{"kept", "trashed"} {
+		err := db.Insert(ImageEntry{ImageName: name, Format: "png", MimeType: "png", Adder: "fakeUser", AdderIP: "fakeIP", Client: "fakeClient"})
+		if err != nil {
+			t.Fatalf("Failed to insert image: %s", err)
+		}
+	}
+	err := db.Trash("trashed")
+	if err != nil {
+		t.Fatalf("Failed to move image to the trash: %s", err)
+	}
+
+	if _, err = db.Query("trashed"); err == nil {
+		t.Errorf("Image in the trash was found with Query")
+	}
+	deleted, err := db.QueryDeleted("trashed")
+	if err != nil || deleted.DeletedAt == 0 {
+		t.Errorf("Image in the trash wasn't found with QueryDeleted: %v %+v", err, deleted)
+	}
+	if _, err = db.QueryDeleted("kept"); err == nil {
+		t.Errorf("Image outside the trash was found with QueryDeleted")
+	}
+	results, _ := db.Search("", "fakeUser", "", 0, 0, true)
+	if len(results) != 1 || results[0].ImageName != "kept" {
+		t.Errorf("Search results didn't match! Expected [kept], but received %+v", results)
+	}
+	trash, _ := db.QueryTrash("fakeUser", 0)
+	if len(trash) != 1 || trash[0].ImageName != "trashed" {
+		t.Errorf("Trash didn't match! Expected [trashed], but received %+v", trash)
+	}
+	if trash, _ = db.QueryTrash("", deleted.DeletedAt-1); len(trash) != 0 {
+		t.Errorf("Recently deleted image was returned for purging: %+v", trash)
+	}
+	if trash, _ = db.QueryTrash("", deleted.DeletedAt+1); len(trash) != 1 {
+		t.Errorf("Old deleted image wasn't returned for purging: %+v", trash)
+	}
+
+	err = db.Restore("trashed")
+	if err != nil {
+		t.Fatalf("Failed to restore image: %s", err)
+	}
+	if restored, err := db.Query("trashed"); err != nil || restored.DeletedAt != 0 {
+		t.Errorf("Restored image wasn't found with Query: %v %+v", err, restored)
+	}
+}
+
+func TestBlobReferences(t *testing.T) {
+	db, cleanup := loadTestDatabase(t)
+	defer cleanup()
+
+	hash := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for i := 0; i < 2; i++ {
+		err := db.AddBlobReference(hash, 123)
+		if err != nil {
+			t.Fatalf("Failed to add blob reference: %s", err)
+		}
+	}
+	for expected := 1; expected >= 0; expected-- {
+		refs, err := db.RemoveBlobReference(hash)
+		if err != nil {
+			t.Fatalf("Failed to remove blob reference: %s", err)
+		} else if refs != expected {
+			t.Errorf("Reference count didn't match! Expected %d, but received %d", expected, refs)
+		}
+	}
+	// The blob was removed with the last reference, so adding a reference creates it again.
+	err := db.AddBlobReference(hash, 123)
+	if err != nil {
+		t.Errorf("Failed to add blob reference after removing blob: %s", err)
+	}
+}
@@ -0,0 +1,125 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dialect contains the SQL driver specific parts of the MIS database.
+type dialect struct {
+	open func(conf SQLConfig) (*sql.DB, error)
+	like string
+	// migrations are the schema upgrades for this dialect. See migrations.go
+	migrations []migration
+	// lockMigrations is ran at the start of every migration transaction to make other servers wait until the migration
+	// is done. unlockMigrations, if set, is ran before committing.
+	lockMigrations   string
+	unlockMigrations string
+	// usersTable is the DDL for the mauth users table. If empty, mauth will create it.
+	usersTable string
+}
+
+var mysqlDialect = &dialect{
+	open: func(conf SQLConfig) (*sql.DB, error) {
+		return sql.Open("mysql", fmt.Sprintf("%[1]s@%[2]s/%[3]s", conf.Authentication.ToString(), conf.Connection.ToString(), conf.Database))
+	},
+	like:       "LIKE",
+	migrations: mysqlMigrations,
+	// DDL statements implicitly commit in MySQL, so a row lock wouldn't be held for the whole migration.
+	lockMigrations:   "SELECT GET_LOCK('mauimageserver_migrations', -1);",
+	unlockMigrations: "SELECT RELEASE_LOCK('mauimageserver_migrations');",
+}
+
+var sqliteDialect = &dialect{
+	open: func(conf SQLConfig) (*sql.DB, error) {
+		// The database field is the path to the database file when using SQLite.
+		return openCompat("sqlite3", "file:"+conf.Database+"?_busy_timeout=5000&_journal_mode=WAL", false)
+	},
+	like:       "LIKE",
+	migrations: sqliteMigrations,
+	// Writing takes the database write lock, which other connections wait for thanks to the busy timeout.
+	lockMigrations: "UPDATE schema_version SET version=version;",
+	usersTable: "CREATE TABLE IF NOT EXISTS users (" +
+		"username VARCHAR(16) PRIMARY KEY," +
+		"password BLOB NOT NULL," +
+		"authtoken BLOB" +
+		");",
+}
+
+var postgresDialect = &dialect{
+	open: func(conf SQLConfig) (*sql.DB, error) {
+		return openCompat("postgres", postgresDSN(conf), true)
+	},
+	// LIKE is case-sensitive in PostgreSQL, unlike in MySQL and SQLite.
+	like:           "ILIKE",
+	migrations:     postgresMigrations,
+	lockMigrations: "SELECT pg_advisory_xact_lock(7265330);",
+	usersTable: "CREATE TABLE IF NOT EXISTS users (" +
+		"username VARCHAR(16) PRIMARY KEY," +
+		"password BYTEA NOT NULL," +
+		"authtoken BYTEA" +
+		");",
+}
+
+// postgresDSN builds a lib/pq connection string from the given SQL config.
+func postgresDSN(conf SQLConfig) string {
+	values := map[string]string{
+		"host":    conf.Connection.IP,
+		"user":    conf.Authentication.Username,
+		"dbname":  conf.Database,
+		"sslmode": conf.Connection.SSLMode,
+	}
+	if !strings.HasPrefix(strings.ToLower(conf.Connection.Mode), "unix") && conf.Connection.Port != 0 {
+		values["port"] = strconv.Itoa(conf.Connection.Port)
+	}
+	if len(conf.Authentication.Password) > 0 {
+		values["password"] = conf.Authentication.Password
+	}
+	keys := make([]string, 0, len(values))
+	for key, value := range values {
+		if len(value) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		value := strings.Replace(values[key], `\`, `\\`, -1)
+		value = strings.Replace(value, "'", `\'`, -1)
+		parts[i] = key + "='" + value + "'"
+	}
+	return strings.Join(parts, " ")
+}
+
+func getDialect(driver string) (*dialect, error) {
+	switch driver {
+	case "", "mysql":
+		return mysqlDialect, nil
+	case "sqlite", "sqlite3":
+		return sqliteDialect, nil
+	case "postgres", "postgresql":
+		return postgresDialect, nil
+	default:
+		return nil, fmt.Errorf("Unknown SQL driver %s", driver)
+	}
+}
@@ -0,0 +1,226 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is a list of statements that upgrade the schema by one version.
+//
+// Every dialect has its own list of migrations, and the lists must always be the same length so that
+// a version number means the same schema on every database. Never edit a released migration, add a new one instead.
+type migration []string
+
+var mysqlMigrations = []migration{{
+	// v1: The original images table. IF NOT EXISTS keeps databases created before migrations working.
+	"CREATE TABLE IF NOT EXISTS images (" +
+		"imgname VARCHAR(32) PRIMARY KEY," +
+		"format VARCHAR(16)," +
+		"mimetype VARCHAR(16)," +
+		"adder VARCHAR(16) NOT NULL," +
+		"adderip VARCHAR(64) NOT NULL," +
+		"client VARCHAR(64) NOT NULL," +
+		"timestamp BIGINT NOT NULL," +
+		"hidden TINYINT(1) NOT NULL," +
+		"id MEDIUMINT UNIQUE KEY AUTO_INCREMENT" +
+		");",
+}, {
+	// v2: Content-addressed image storage
+	"CREATE TABLE blobs (hash CHAR(64) PRIMARY KEY, refcount INT NOT NULL, size BIGINT NOT NULL);",
+	"ALTER TABLE images ADD COLUMN hash CHAR(64);",
+}, {
+	// v3: Image dimensions and file size
+	"ALTER TABLE images ADD COLUMN width INTEGER;",
+	"ALTER TABLE images ADD COLUMN height INTEGER;",
+	"ALTER TABLE images ADD COLUMN bytes BIGINT;",
+}, {
+	// v4: Public, unlisted and private images
+	"ALTER TABLE images ADD COLUMN visibility VARCHAR(16);",
+	"UPDATE images SET visibility='unlisted' WHERE hidden<>0;",
+	"UPDATE images SET visibility='public' WHERE hidden=0;",
+}, {
+	// v5: Expiring images
+	"ALTER TABLE images ADD COLUMN expires BIGINT;",
+	"ALTER TABLE images ADD COLUMN maxviews INTEGER;",
+	"ALTER TABLE images ADD COLUMN views INTEGER NOT NULL DEFAULT 0;",
+}, {
+	// v6: Password-protected images. The password is a bcrypt hash.
+	"ALTER TABLE images ADD COLUMN password VARCHAR(60);",
+}, {
+	// v7: Trash for deleted images
+	"ALTER TABLE images ADD COLUMN deleted_at BIGINT;",
+}}
+
+var sqliteMigrations = []migration{{
+	// v1: SQLite only supports autoincrement on the primary key, so imgname is a separate unique column.
+	"CREATE TABLE IF NOT EXISTS images (" +
+		"imgname VARCHAR(32) NOT NULL UNIQUE," +
+		"format VARCHAR(16)," +
+		"mimetype VARCHAR(16)," +
+		"adder VARCHAR(16) NOT NULL," +
+		"adderip VARCHAR(64) NOT NULL," +
+		"client VARCHAR(64) NOT NULL," +
+		"timestamp BIGINT NOT NULL," +
+		"hidden INTEGER NOT NULL," +
+		"id INTEGER PRIMARY KEY AUTOINCREMENT" +
+		");",
+}, {
+	// v2
+	"CREATE TABLE blobs (hash CHAR(64) PRIMARY KEY, refcount INTEGER NOT NULL, size BIGINT NOT NULL);",
+	"ALTER TABLE images ADD COLUMN hash CHAR(64);",
+}, {
+	// v3
+	"ALTER TABLE images ADD COLUMN width INTEGER;",
+	"ALTER TABLE images ADD COLUMN height INTEGER;",
+	"ALTER TABLE images ADD COLUMN bytes BIGINT;",
+}, {
+	// v4
+	"ALTER TABLE images ADD COLUMN visibility VARCHAR(16);",
+	"UPDATE images SET visibility='unlisted' WHERE hidden<>0;",
+	"UPDATE images SET visibility='public' WHERE hidden=0;",
+}, {
+	// v5
+	"ALTER TABLE images ADD COLUMN expires BIGINT;",
+	"ALTER TABLE images ADD COLUMN maxviews INTEGER;",
+	"ALTER TABLE images ADD COLUMN views INTEGER NOT NULL DEFAULT 0;",
+}, {
+	// v6
+	"ALTER TABLE images ADD COLUMN password VARCHAR(60);",
+}, {
+	// v7
+	"ALTER TABLE images ADD COLUMN deleted_at BIGINT;",
+}}
+
+var postgresMigrations = []migration{{
+	// v1
+	"CREATE TABLE IF NOT EXISTS images (" +
+		"imgname VARCHAR(32) PRIMARY KEY," +
+		"format VARCHAR(16)," +
+		"mimetype VARCHAR(16)," +
+		"adder VARCHAR(16) NOT NULL," +
+		"adderip VARCHAR(64) NOT NULL," +
+		"client VARCHAR(64) NOT NULL," +
+		"timestamp BIGINT NOT NULL," +
+		"hidden SMALLINT NOT NULL," +
+		"id SERIAL UNIQUE" +
+		");",
+}, {
+	// v2
+	"CREATE TABLE blobs (hash CHAR(64) PRIMARY KEY, refcount INTEGER NOT NULL, size BIGINT NOT NULL);",
+	"ALTER TABLE images ADD COLUMN hash CHAR(64);",
+}, {
+	// v3
+	"ALTER TABLE images ADD COLUMN width INTEGER;",
+	"ALTER TABLE images ADD COLUMN height INTEGER;",
+	"ALTER TABLE images ADD COLUMN bytes BIGINT;",
+}, {
+	// v4
+	"ALTER TABLE images ADD COLUMN visibility VARCHAR(16);",
+	"UPDATE images SET visibility='unlisted' WHERE hidden<>0;",
+	"UPDATE images SET visibility='public' WHERE hidden=0;",
+}, {
+	// v5
+	"ALTER TABLE images ADD COLUMN expires BIGINT;",
+	"ALTER TABLE images ADD COLUMN maxviews INTEGER;",
+	"ALTER TABLE images ADD COLUMN views INTEGER NOT NULL DEFAULT 0;",
+}, {
+	// v6
+	"ALTER TABLE images ADD COLUMN password VARCHAR(60);",
+}, {
+	// v7
+	"ALTER TABLE images ADD COLUMN deleted_at BIGINT;",
+}}
+
+// schemaVersion gets the current schema version from the schema_version table, creating the table if necessary.
+func (data *mis) schemaVersion() (int, error) {
+	_, err := data.db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL);")
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	err = data.db.QueryRow("SELECT version FROM schema_version;").Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = data.db.Exec("INSERT INTO schema_version (version) VALUES (0);")
+		return 0, err
+	}
+	return version, err
+}
+
+// upgrade runs all the migrations that haven't been ran yet.
+func (data *mis) upgrade() error {
+	version, err := data.schemaVersion()
+	if err != nil {
+		return err
+	}
+	migrations := data.dialect.migrations
+	if version > len(migrations) {
+		return fmt.Errorf("Database schema version %[1]d is newer than the latest known version %[2]d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		err = data.migrate(version+1, migrations[version])
+		if err != nil {
+			return fmt.Errorf("Failed to upgrade database schema to version %[1]d: %[2]s", version+1, err)
+		}
+	}
+	return nil
+}
+
+// migrate runs the given migration and bumps the schema version in a single transaction. The transaction holds the
+// dialect's migration lock, and the migration is skipped if another server already ran it while this one was waiting.
+func (data *mis) migrate(version int, statements migration) error {
+	// Note that DDL statements can't be rolled back in MySQL.
+	tx, err := data.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = data.migrateTx(tx, version, statements)
+	if len(data.dialect.unlockMigrations) > 0 {
+		// The lock belongs to the connection rather than the transaction, so it must be released in both cases.
+		_, unlockErr := tx.Exec(data.dialect.unlockMigrations)
+		if err == nil {
+			err = unlockErr
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (data *mis) migrateTx(tx *sql.Tx, version int, statements migration) error {
+	_, err := tx.Exec(data.dialect.lockMigrations)
+	if err != nil {
+		return err
+	}
+	var current int
+	err = tx.QueryRow("SELECT version FROM schema_version;").Scan(&current)
+	if err != nil || current >= version {
+		return err
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE schema_version SET version=?;", version)
+	return err
+}
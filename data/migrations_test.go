@@ -0,0 +1,84 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationCount(t *testing.T) {
+	if len(mysqlMigrations) != len(sqliteMigrations) || len(mysqlMigrations) != len(postgresMigrations) {
+		t.Errorf("Migration counts differ: MySQL has %d, SQLite %d and PostgreSQL %d",
+			len(mysqlMigrations), len(sqliteMigrations), len(postgresMigrations))
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mis-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := SQLConfig{Driver: "sqlite3", Database: filepath.Join(dir, "mis.db")}
+
+	// Load the database twice to make sure that already applied migrations are skipped.
+	for i := 0; i < 2; i++ {
+		db := CreateDatabase(conf).(*mis)
+		err = db.Load()
+		if err != nil {
+			t.Fatalf("Failed to load database: %s", err)
+		}
+		version, err := db.schemaVersion()
+		if err != nil {
+			t.Errorf("Failed to get schema version: %s", err)
+		} else if version != len(sqliteMigrations) {
+			t.Errorf("Schema version didn't match! Expected %d, but received %d", len(sqliteMigrations), version)
+		}
+		db.Unload()
+	}
+}
+
+func TestMigrateAlreadyApplied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mis-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	db := CreateDatabase(SQLConfig{Driver: "sqlite3", Database: filepath.Join(dir, "mis.db")}).(*mis)
+	err = db.Load()
+	if err != nil {
+		t.Fatalf("Failed to load database: %s", err)
+	}
+	defer db.Unload()
+
+	// Another server upgrading the schema first must not make this one run the same migration again.
+	err = db.migrate(1, migration{"CREATE TABLE images (imgname VARCHAR(32));"})
+	if err != nil {
+		t.Errorf("Already applied migration wasn't skipped: %s", err)
+	}
+	version, err := db.schemaVersion()
+	if err != nil {
+		t.Errorf("Failed to get schema version: %s", err)
+	} else if version != len(sqliteMigrations) {
+		t.Errorf("Schema version didn't match! Expected %d, but received %d", len(sqliteMigrations), version)
+	}
+}
@@ -0,0 +1,376 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3Store struct {
+	conf     S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// CreateS3Store creates an ImageStore that stores files in a bucket of an S3-compatible object storage.
+func CreateS3Store(config S3Config) (ImageStore, error) {
+	if len(config.Bucket) == 0 {
+		return nil, fmt.Errorf("No S3 bucket specified")
+	}
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = "https://s3.amazonaws.com"
+	}
+	if len(config.Region) == 0 {
+		config.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	} else if len(endpoint.Scheme) == 0 || len(endpoint.Host) == 0 {
+		return nil, fmt.Errorf("Invalid S3 endpoint %s", config.Endpoint)
+	}
+	return &s3Store{conf: config, endpoint: endpoint, client: http.DefaultClient, now: time.Now}, nil
+}
+
+func (store *s3Store) key(name string) string {
+	return store.conf.Prefix + strings.TrimPrefix(name, "/")
+}
+
+// url builds the URL of the given object key. An empty key points to the bucket itself.
+func (store *s3Store) url(key string, query url.Values) *url.URL {
+	u := *store.endpoint
+	if store.conf.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + store.conf.Bucket + "/" + key
+	} else {
+		u.Host = store.conf.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = encodePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (store *s3Store) request(method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, store.url(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	store.sign(req, payloadHash)
+	return store.client.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 authorization header to the given request.
+func (store *s3Store) sign(req *http.Request, payloadHash string) {
+	now := store.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + store.conf.Region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Collect the headers to sign.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "content-type" || name == "content-md5" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		encodePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+store.conf.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, store.conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%[1]s/%[2]s, SignedHeaders=%[3]s, Signature=%[4]s",
+		store.conf.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// encodeURI escapes everything except the unreserved characters of RFC 3986, as required by AWS signatures.
+func encodeURI(str string, keepSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(str) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (keepSlash && b == '/') {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func encodePath(path string) string {
+	if len(path) == 0 {
+		return "/"
+	}
+	return encodeURI(path, true)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, encodeURI(key, false)+"="+encodeURI(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// responseError turns an unsuccessful S3 response into an error.
+func responseError(op, key string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	var s3err s3Error
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(body, &s3err) != nil || len(s3err.Code) == 0 {
+		return fmt.Errorf("S3 %[1]s %[2]s failed: %[3]s", op, key, resp.Status)
+	}
+	return fmt.Errorf("S3 %[1]s %[2]s failed: %[3]s: %[4]s", op, key, s3err.Code, s3err.Message)
+}
+
+func (store *s3Store) Put(name string, data io.Reader) error {
+	// S3 needs the length of the body in advance, so spool the data into a temporary file first.
+	tmp, err := ioutil.TempFile("", "mis-s3-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), data)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	key := store.key(name)
+	resp, err := store.request(http.MethodPut, key, nil, nil, tmp, size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError("put", key, resp)
+	}
+	return nil
+}
+
+func (store *s3Store) Stat(name string) (FileInfo, error) {
+	key := store.key(name)
+	resp, err := store.request(http.MethodHead, key, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return FileInfo{}, responseError("stat", key, resp)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: name, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (store *s3Store) Open(name string) (ImageFile, error) {
+	info, err := store.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{store: store, key: store.key(name), size: info.Size}, nil
+}
+
+func (store *s3Store) Delete(name string) error {
+	key := store.key(name)
+	resp, err := store.request(http.MethodDelete, key, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return responseError("delete", key, resp)
+	}
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (store *s3Store) List() ([]string, error) {
+	var names []string
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {store.conf.Prefix}}
+		if len(token) > 0 {
+			query.Set("continuation-token", token)
+		}
+		resp, err := store.request(http.MethodGet, "", query, nil, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = responseError("list", store.conf.Prefix, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			names = append(names, strings.TrimPrefix(obj.Key, store.conf.Prefix))
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// s3File is a seekable reader for an S3 object. The object is fetched lazily using ranged GET requests.
+type s3File struct {
+	store  *s3Store
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (file *s3File) Read(p []byte) (int, error) {
+	if file.offset >= file.size {
+		return 0, io.EOF
+	}
+	if file.body == nil {
+		header := http.Header{}
+		if file.offset > 0 {
+			header.Set("Range", "bytes="+strconv.FormatInt(file.offset, 10)+"-")
+		}
+		resp, err := file.store.request(http.MethodGet, file.key, nil, header, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		} else if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			err = responseError("get", file.key, resp)
+			resp.Body.Close()
+			return 0, err
+		}
+		file.body = resp.Body
+	}
+	n, err := file.body.Read(p)
+	file.offset += int64(n)
+	return n, err
+}
+
+func (file *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += file.offset
+	case io.SeekEnd:
+		offset += file.size
+	}
+	if offset < 0 {
+		return file.offset, fmt.Errorf("Negative seek offset")
+	}
+	if offset != file.offset && file.body != nil {
+		file.body.Close()
+		file.body = nil
+	}
+	file.offset = offset
+	return offset, nil
+}
+
+func (file *s3File) Close() error {
+	if file.body != nil {
+		return file.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ImageStore is the interface for the backends that store the actual image files.
+//
+// File names are slash-separated paths relative to the root of the store.
+// Errors caused by a file not existing must satisfy os.IsNotExist.
+type ImageStore interface {
+	// Put stores everything read from the given reader as the file with the given name, replacing any previous file.
+	Put(name string, data io.Reader) error
+	// Open opens the file with the given name for reading.
+	Open(name string) (ImageFile, error)
+	// Stat returns basic details of the file with the given name.
+	Stat(name string) (FileInfo, error)
+	// Delete removes the file with the given name.
+	Delete(name string) error
+	// List returns the names of all files in the store.
+	List() ([]string, error)
+}
+
+// ImageFile is a file opened from an ImageStore.
+type ImageFile interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// FileInfo contains basic details of a file in an ImageStore.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// CreateImageStore creates the ImageStore selected in the given configuration.
+func CreateImageStore(config *Configuration) (ImageStore, error) {
+	switch config.Storage {
+	case "", "local":
+		return CreateLocalStore(config.ImageLocation), nil
+	case "s3":
+		return CreateS3Store(config.S3)
+	default:
+		return nil, fmt.Errorf("Unknown storage backend %s", config.Storage)
+	}
+}
+
+type localStore struct {
+	root string
+}
+
+// CreateLocalStore creates an ImageStore that stores files in the given directory.
+func CreateLocalStore(root string) ImageStore {
+	return &localStore{root: root}
+}
+
+func (store *localStore) path(name string) string {
+	// Cleaning the name as an absolute path makes sure it can't escape the root directory.
+	return filepath.Join(store.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (store *localStore) Put(name string, data io.Reader) error {
+	file := store.path(name)
+	dir := filepath.Dir(file)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that readers never see a partially written image.
+	tmp, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (store *localStore) Open(name string) (ImageFile, error) {
+	return os.Open(store.path(name))
+}
+
+func (store *localStore) Stat(name string) (FileInfo, error) {
+	info, err := os.Stat(store.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (store *localStore) Delete(name string) error {
+	return os.Remove(store.path(name))
+}
+
+func (store *localStore) List() ([]string, error) {
+	var names []string
+	err := filepath.Walk(store.root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(store.root, file)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if path.Base(name)[0] != '.' {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
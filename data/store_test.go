@@ -0,0 +1,64 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package data contains all data storage things (config, database, etc...)
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStoreTraversal(t *testing.T) {
+	parent, err := ioutil.TempDir("", "mis-store-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(parent)
+	root := filepath.Join(parent, "images")
+	err = ioutil.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to create file: %s", err)
+	}
+	store := CreateLocalStore(root)
+
+	for _, name := range []string{"../secret", "../../secret", "/../secret", "blobs/../../secret", "..\\secret"} {
+		path := store.(*localStore).path(name)
+		if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			t.Errorf("Path of %s is outside the root directory: %s", name, path)
+		}
+		if _, err = store.Open(name); err == nil {
+			t.Errorf("Opening %s succeeded", name)
+		}
+	}
+
+	err = store.Put("../escaped", strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("Failed to put file: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(parent, "escaped")); err == nil {
+		t.Errorf("File was written outside the root directory")
+	} else if _, err = os.Stat(filepath.Join(root, "escaped")); err != nil {
+		t.Errorf("File wasn't written inside the root directory: %s", err)
+	}
+	err = store.Delete("../secret")
+	if _, statErr := os.Stat(filepath.Join(parent, "secret")); err == nil || statErr != nil {
+		t.Errorf("File outside the root directory was deleted")
+	}
+}
@@ -28,10 +28,30 @@ var image *template.Template
 type ImagePage struct {
 	ImageName string
 	ImageAddr string
-	Uploader  string
-	Date      string
-	Client    string
-	Index     string
+	// ThumbnailAddr is the address of the largest thumbnail, which is shown on the page instead of the original.
+	ThumbnailAddr string
+	Uploader      string
+	Date          string
+	Client        string
+	Index         string
+	// Width and Height are zero if the dimensions of the image are unknown.
+	Width  int
+	Height int
+	// Size is the human-readable size of the image file.
+	Size   string
+	SHA256 string
+	// PageURL, ImageURL and OEmbedURL are absolute addresses for link previews (OpenGraph, Twitter Cards and oEmbed).
+	// The image isn't included in link previews if ImageURL is empty.
+	PageURL   string
+	ImageURL  string
+	OEmbedURL string
+	// MimeType is the full MIME type of the image, e.g. image/png.
+	MimeType string
+	// If Locked is true, the image has a password and the page shows a form that is posted to UnlockAddr instead of
+	// the image. UnlockError is the error message of a failed unlock attempt.
+	Locked      bool
+	UnlockAddr  string
+	UnlockError string
 }
 
 // Send sends this ImagePage to the given response writer.
@@ -0,0 +1,94 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ImageInfoResponse is the response for image info requests.
+type ImageInfoResponse struct {
+	Success        bool          `json:"success"`
+	Status         string        `json:"status-simple"`
+	StatusReadable string        `json:"status-humanreadable"`
+	Image          *SearchResult `json:"image,omitempty"`
+}
+
+// ImageInfo handles image info requests (GET /api/images/{name}).
+//
+// Authentication is optional and uses the X-Username and X-Auth-Token headers. Private images are only shown to the
+// user who uploaded them or with a signed link, and don't exist for others.
+//
+// Unlike Delete and Hide, this never responds with 403 Forbidden. Reading is the only thing the API does, and the only
+// image that can't be read is a private image of another user, which would be revealed to exist by a 403.
+func ImageInfo(w http.ResponseWriter, r *http.Request) {
+	var ip = getIP(r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	imageName := strings.TrimPrefix(r.URL.Path, "/api/images/")
+	if len(imageName) == 0 || strings.ContainsRune(imageName, '/') {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	username, err := requestUser(r)
+	if err != nil {
+		log.Debugf("%[1]s tried to authenticate as %[2]s with the wrong token.", ip, r.Header.Get("X-Username"))
+		output(w, ImageInfoResponse{
+			Success:        false,
+			Status:         "invalid-authtoken",
+			StatusReadable: "The authentication token was incorrect. Please try logging in again.",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	img, err := database.Query(imageName)
+	if err != nil || !canView(r, img) {
+		// Private images look like they don't exist, so that their names can't be found by guessing.
+		log.Debugf("%[1]s requested info of %[2]s, which doesn't exist or is private.", ip, imageName)
+		output(w, ImageInfoResponse{Success: false, Status: "not-found",
+			StatusReadable: "The image you requested does not exist."}, http.StatusNotFound)
+		return
+	} else if img.Expired(time.Now()) {
+		log.Debugf("%[1]s requested info of %[2]s, which has expired.", ip, imageName)
+		output(w, ImageInfoResponse{Success: false, Status: "expired",
+			StatusReadable: "The image you requested has expired."}, http.StatusGone)
+		return
+	}
+
+	// The IP address of the uploader is never shown to others.
+	if img.Adder != username || img.Adder == "anonymous" {
+		img.AdderIP = ""
+	}
+	result := searchResult(img)
+	if !unlocked(r, img) {
+		result = SearchResult{ImageEntry: lockedEntry(img)}
+	}
+	output(w, ImageInfoResponse{
+		Success:        true,
+		Status:         "found",
+		StatusReadable: "Found the image " + img.ImageName,
+		Image:          &result,
+	}, http.StatusOK)
+}
@@ -0,0 +1,175 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImageInfo(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", Adder: "fakeUser", AdderIP: "fakeIP", Hash: fakeHash}
+	unlisted := image
+	unlisted.Hidden, unlisted.Visibility = true, data.VisibilityUnlisted
+	limited := image
+	limited.MaxViews = 2
+	expired := limited
+	expired.Views = 2
+	private := image
+	private.Hidden, private.Visibility = true, data.VisibilityPrivate
+	protected := image
+	protected.Protected, protected.Width, protected.Height, protected.Bytes = true, 20, 10, 1234
+	owner := map[string]string{"X-Username": "fakeUser", "X-Auth-Token": "fakeAuthToken"}
+	assertLocked := func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+		var received ImageInfoResponse
+		err := json.Unmarshal(recorder.Body.Bytes(), &received)
+		if recorder.Code != c.status {
+			t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, c.status, recorder.Code)
+		} else if err != nil || received.Image == nil || !received.Image.Protected {
+			t.Errorf("[%s #%d] Response doesn't contain a protected image: %s", c.path, index, recorder.Body.String())
+		} else if strings.Contains(recorder.Body.String(), fakeHash) || received.Image.Bytes != 0 || len(received.Image.ThumbnailURL) > 0 {
+			t.Errorf("[%s #%d] Response contains details of the locked image: %s", c.path, index, recorder.Body.String())
+		}
+	}
+	assertImage := func(adderIP string) func(int, test, *testing.T, *httptest.ResponseRecorder) {
+		return func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			var received ImageInfoResponse
+			err := json.Unmarshal(recorder.Body.Bytes(), &received)
+			if recorder.Code != c.status {
+				t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, c.status, recorder.Code)
+			} else if err != nil || received.Image == nil {
+				t.Errorf("[%s #%d] Response doesn't contain an image: %s", c.path, index, recorder.Body.String())
+			} else if received.Image.ImageName != "fakeImage" || received.Image.Hash != fakeHash {
+				t.Errorf("[%s #%d] Image didn't match! Received %+v", c.path, index, received.Image)
+			} else if received.Image.AdderIP != adderIP {
+				t.Errorf("[%s #%d] Uploader IP didn't match! Expected %q, but received %q", c.path, index, adderIP, received.Image.AdderIP)
+			} else if received.Image.ThumbnailURL != "/thumb/fakeImage?size=256" {
+				t.Errorf("[%s #%d] Thumbnail URL didn't match! Received %s", c.path, index, received.Image.ThumbnailURL)
+			}
+		}
+	}
+	cases := []test{{
+		action: "POST", path: "/api/images/fakeImage", assert: defaultAssert,
+		status:   http.StatusMethodNotAllowed,
+		config:   &data.Configuration{},
+		database: fakeDatabase{},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: assertImage(""),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: assertImage("fakeIP"),
+		headers:  owner,
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: assertLocked,
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: protected},
+	}, {
+		// Loading the thumbnail would use up a view.
+		action: "GET", path: "/api/images/fakeImage",
+		assert: func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			var received ImageInfoResponse
+			json.Unmarshal(recorder.Body.Bytes(), &received)
+			if recorder.Code != c.status || received.Image == nil || len(received.Image.ThumbnailURL) > 0 {
+				t.Errorf("[%s #%d] Response has a thumbnail URL: %s", c.path, index, recorder.Body.String())
+			}
+		},
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: limited},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: defaultAssert,
+		status:   http.StatusGone,
+		expected: &GenericResponse{Success: false, Status: "expired"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: expired},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: assertImage("fakeIP"),
+		headers:  owner,
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: protected},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: defaultAssert,
+		status:   http.StatusNotFound,
+		expected: &GenericResponse{Success: false, Status: "not-found"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryError: errors.New("fakeError")},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: defaultAssert,
+		status:   http.StatusNotFound,
+		expected: &GenericResponse{Success: false, Status: "not-found"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: private},
+	}, {
+		// Anyone who knows the name of an unlisted image can view it.
+		action: "GET", path: "/api/images/fakeImage", assert: assertImage(""),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: unlisted},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: defaultAssert,
+		headers:  map[string]string{"X-Username": "fakeUser2", "X-Auth-Token": "fakeAuthToken"},
+		status:   http.StatusNotFound,
+		expected: &GenericResponse{Success: false, Status: "not-found"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: private},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: assertImage("fakeIP"),
+		headers:  owner,
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: private},
+	}, {
+		action: "GET", path: "/api/images/fakeImage", assert: defaultAssert,
+		headers:  owner,
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "invalid-authtoken"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{authTokenError: errors.New("fakeError")},
+		database: fakeDatabase{queryImage: image},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
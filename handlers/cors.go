@@ -0,0 +1,95 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCORSHeaders are the request headers allowed in cross-origin requests if the config doesn't list any.
+var defaultCORSHeaders = []string{
+	"Content-Type", "Range", "If-None-Match", "If-Modified-Since", "Upload-Offset",
+	"X-Username", "X-Auth-Token", "X-Image-Format", "X-Client-Name", "X-Hidden", "X-Visibility", "X-Keep-Metadata",
+	"X-Expires-At", "X-TTL", "X-Max-Views", "X-Password",
+}
+
+// corsExposedHeaders are the response headers that cross-origin scripts can read.
+var corsExposedHeaders = "ETag, Last-Modified, Content-Range, Location, Upload-Offset, Upload-Length"
+
+// CORS wraps the given handler so that it answers OPTIONS requests, including CORS preflight requests, and adds the
+// CORS headers configured in the cors section of the config to responses for allowed origins. The methods are the
+// ones the handler accepts, e.g. "GET, HEAD".
+func CORS(methods string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		var allowed, listed bool
+		if len(origin) > 0 {
+			allowed, listed = originAllowed(origin)
+		}
+		if allowed {
+			// The origin is always sent back instead of *, as * doesn't work with credentials.
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			// Credentials include the unlock cookies of password-protected images, so they're only allowed for the
+			// origins that are listed explicitly. Otherwise any website could read the images a visitor has unlocked.
+			if config.CORS.AllowCredentials && listed {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if len(config.CORS.AllowedOrigins) > 0 {
+			// Caches must not send a response with the CORS headers of one origin to another origin.
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method != "OPTIONS" {
+			if allowed {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			}
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", methods+", OPTIONS")
+		if allowed && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			headers := config.CORS.AllowedHeaders
+			if len(headers) == 0 {
+				headers = defaultCORSHeaders
+			}
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			if config.CORS.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.CORS.MaxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// originAllowed checks if the given origin is allowed by the list of allowed origins in the config. * allows all
+// origins, but listed is only true if the origin is in the list explicitly.
+func originAllowed(origin string) (allowed, listed bool) {
+	for _, item := range config.CORS.AllowedOrigins {
+		if strings.EqualFold(item, origin) {
+			return true, true
+		} else if item == "*" {
+			allowed = true
+		}
+	}
+	return allowed, false
+}
@@ -0,0 +1,123 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"maunium.net/go/mauimageserver/data"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	conf := &data.Configuration{CORS: data.CORSConfig{
+		AllowedOrigins:   []string{"https://tools.example.com"},
+		AllowedHeaders:   []string{"Content-Type", "X-Auth-Token"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}}
+	handler := CORS("POST", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	cases := []struct {
+		method  string
+		origin  string
+		status  int
+		headers map[string]string
+	}{{
+		method: "OPTIONS", origin: "https://tools.example.com", status: http.StatusNoContent,
+		headers: map[string]string{
+			"Allow":                            "POST, OPTIONS",
+			"Access-Control-Allow-Origin":      "https://tools.example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods":     "POST",
+			"Access-Control-Allow-Headers":     "Content-Type, X-Auth-Token",
+			"Access-Control-Max-Age":           "600",
+			"Vary":                             "Origin",
+		},
+	}, {
+		method: "OPTIONS", origin: "https://evil.example.com", status: http.StatusNoContent,
+		headers: map[string]string{
+			"Allow":                        "POST, OPTIONS",
+			"Access-Control-Allow-Origin":  "",
+			"Access-Control-Allow-Methods": "",
+		},
+	}, {
+		method: "POST", origin: "https://tools.example.com", status: http.StatusCreated,
+		headers: map[string]string{
+			"Access-Control-Allow-Origin":   "https://tools.example.com",
+			"Access-Control-Expose-Headers": corsExposedHeaders,
+			"Access-Control-Allow-Methods":  "",
+		},
+	}, {
+		method: "POST", status: http.StatusCreated,
+		headers: map[string]string{"Access-Control-Allow-Origin": ""},
+	}}
+
+	Init(conf, nil, nil, nil)
+	for index, c := range cases {
+		req, _ := http.NewRequest(c.method, "/insert", nil)
+		if len(c.origin) > 0 {
+			req.Header.Set("Origin", c.origin)
+			if c.method == "OPTIONS" {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		if recorder.Code != c.status {
+			t.Errorf("[#%d] Status code didn't match! Expected %d, but received %d", index+1, c.status, recorder.Code)
+		}
+		for header, value := range c.headers {
+			if received := recorder.Header().Get(header); received != value {
+				t.Errorf("[#%d] %s didn't match! Expected %q, but received %q", index+1, header, value, received)
+			}
+		}
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	Init(&data.Configuration{CORS: data.CORSConfig{
+		AllowedOrigins:   []string{"*", "https://tools.example.com"},
+		AllowCredentials: true,
+	}}, nil, nil, nil)
+	handler := CORS("GET", func(w http.ResponseWriter, r *http.Request) {})
+	// Only the origins that are listed explicitly can send credentials, such as the unlock cookies of images.
+	for origin, credentials := range map[string]string{"https://tools.example.com": "true", "https://evil.example.com": ""} {
+		req, _ := http.NewRequest("GET", "/fakeImage", nil)
+		req.Header.Set("Origin", origin)
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		if received := recorder.Header().Get("Access-Control-Allow-Origin"); received != origin {
+			t.Errorf("[%s] Allowed origin didn't match! Expected %q, but received %q", origin, origin, received)
+		}
+		if received := recorder.Header().Get("Access-Control-Allow-Credentials"); received != credentials {
+			t.Errorf("[%s] Allowed credentials didn't match! Expected %q, but received %q", origin, credentials, received)
+		}
+	}
+}
+
+func TestDefaultCORSHeaders(t *testing.T) {
+	// The headers that raw uploads can be configured with.
+	for _, header := range []string{"X-Image-Format", "X-Client-Name", "X-Hidden", "X-Visibility", "X-Keep-Metadata",
+		"X-Expires-At", "X-TTL", "X-Max-Views", "X-Password"} {
+		if !containsString(defaultCORSHeaders, header) {
+			t.Errorf("%s isn't allowed in cross-origin requests", header)
+		}
+	}
+}
@@ -22,17 +22,19 @@ import (
 	log "maunium.net/go/maulogger"
 	"net/http"
 	"os"
-	"strings"
 )
 
-// DeleteForm is the form for deleting images. AuthToken is required.
+// DeleteForm is the form for deleting and restoring images. AuthToken is required.
 type DeleteForm struct {
 	ImageName string `json:"image-name"`
 	Username  string `json:"username"`
 	AuthToken string `json:"auth-token"`
+	// Permanent deletes the image right away instead of moving it to the trash. Also works for images in the trash.
+	Permanent bool `json:"permanent"`
 }
 
-// Delete handles delete requests
+// Delete handles delete requests. Images are moved to the trash unless the trash is disabled or the request is for
+// permanent deletion.
 func Delete(w http.ResponseWriter, r *http.Request) {
 	var ip = getIP(r)
 	if r.Method != "POST" {
@@ -66,6 +68,9 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	data, err := database.Query(dfr.ImageName)
+	if err != nil && dfr.Permanent {
+		data, err = database.QueryDeleted(dfr.ImageName)
+	}
 	if err != nil {
 		log.Debugf("%[1]s@%[2]s attempted to delete an image that doesn't exist.", dfr.Username, ip, data.Adder)
 		output(w, GenericResponse{Success: false, Status: "not-found", StatusReadable: "The image you requested to be deleted does not exist."}, http.StatusNotFound)
@@ -78,19 +83,35 @@ func Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !dfr.Permanent && trashEnabled() {
+		err = database.Trash(dfr.ImageName)
+		if err != nil {
+			log.Warnf("Error moving %[4]s to the trash (requested by %[1]s@%[2]s): %[3]s", dfr.Username, ip, err, dfr.ImageName)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log.Debugf("%[1]s@%[2]s successfully moved the image with the name %[3]s to the trash.", dfr.Username, ip, dfr.ImageName)
+		output(w, GenericResponse{
+			Success:        true,
+			Status:         "deleted",
+			StatusReadable: "The image " + dfr.ImageName + " was moved to the trash.",
+		}, http.StatusAccepted)
+		return
+	}
+
 	err = database.Remove(dfr.ImageName)
 	if err != nil {
 		log.Warnf("Error deleting %[4]s from the database (requested by %[1]s@%[2]s): %[3]s", dfr.Username, ip, err, dfr.ImageName)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	err = os.Remove(config.ImageLocation + "/" + dfr.ImageName + "." + data.Format)
+	err = removeImageFile(data)
 	if err != nil {
 		// If the file just didn't exist, warn about the error. If the error was something else, cancel.
-		if strings.HasSuffix(err.Error(), "no such file or directory") {
-			log.Warnf("Error deleting %[3]s from the filesystem (requested by %[1]s@%[2]s): File not found", dfr.Username, ip, dfr.ImageName)
+		if os.IsNotExist(err) {
+			log.Warnf("Error deleting %[3]s from the image store (requested by %[1]s@%[2]s): File not found", dfr.Username, ip, dfr.ImageName)
 		} else {
-			log.Errorf("Error deleting %[4]s from the filesystem (requested by %[1]s@%[2]s): %[3]s", dfr.Username, ip, err, dfr.ImageName)
+			log.Errorf("Error deleting %[4]s from the image store (requested by %[1]s@%[2]s): %[3]s", dfr.Username, ip, err, dfr.ImageName)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -22,6 +22,7 @@ import (
 	"maunium.net/go/mauimageserver/data"
 	log "maunium.net/go/maulogger"
 	"net/http"
+	"os"
 	"testing"
 )
 
@@ -70,7 +71,7 @@ func TestDelete(t *testing.T) {
 		database: fakeDatabase{queryError: errors.New("asd")},
 	}, {
 		action: "POST", path: "/delete", assert: defaultAssert,
-		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"permanent\": true}",
 		status:   http.StatusInternalServerError,
 		expected: nil,
 		config:   &data.Configuration{ImageLocation: "/tmp"},
@@ -78,22 +79,92 @@ func TestDelete(t *testing.T) {
 		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}, removeError: errors.New("fakeError")},
 	}, {
 		action: "POST", path: "/delete", assert: defaultAssert,
-		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"permanent\": true}",
 		status:   http.StatusAccepted,
 		expected: &GenericResponse{Success: true, Status: "deleted"},
 		config:   &data.Configuration{ImageLocation: "/"},
 		auth:     fakeAuth{},
 		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}},
-	}}
-
-	/*{ TODO: Create a test case that makes os.Remove throw an error other than no such file or directory.
-		request:  "{\"image-name\":\"fake/Image\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+	}, {
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"permanent\": true}",
+		status:   http.StatusAccepted,
+		expected: &GenericResponse{Success: true, Status: "deleted"},
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}},
+		store:    fakeStore{deleteError: os.ErrNotExist},
+	}, {
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"permanent\": true}",
+		status:   http.StatusInternalServerError,
+		expected: nil,
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}},
+		store:    fakeStore{deleteError: errors.New("fakeError")},
+	}, {
+		// The blob is still used by another image, so it must not be deleted.
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"permanent\": true}",
+		status:   http.StatusAccepted,
+		expected: &GenericResponse{Success: true, Status: "deleted"},
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser", Hash: fakeHash}, blobRefs: 1},
+		store:    fakeStore{deleteError: errors.New("fakeError")},
+	}, {
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"permanent\": true}",
+		status:   http.StatusInternalServerError,
+		expected: nil,
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser", Hash: fakeHash}, blobError: errors.New("fakeError")},
+	}, {
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusAccepted,
+		expected: &GenericResponse{Success: true, Status: "deleted"},
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}, removeError: errors.New("fakeError")},
+		store:    fakeStore{deleteError: errors.New("fakeError")},
+	}, {
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
 		status:   http.StatusInternalServerError,
 		expected: nil,
 		config:   &data.Configuration{ImageLocation: "/tmp"},
 		auth:     fakeAuth{},
-		database: fakeDatabase{imageOwner: "fakeUser"},
-	},*/
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}, trashError: errors.New("fakeError")},
+	}, {
+		// The trash is disabled, so the image is removed right away.
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusInternalServerError,
+		expected: nil,
+		config:   &data.Configuration{ImageLocation: "/tmp", TrashRetention: -1},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}, removeError: errors.New("fakeError")},
+	}, {
+		// Images in the trash can only be deleted permanently.
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusNotFound,
+		expected: &GenericResponse{Success: false, Status: "not-found"},
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryError: errors.New("asd"), deletedImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}},
+	}, {
+		action: "POST", path: "/delete", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"permanent\": true}",
+		status:   http.StatusAccepted,
+		expected: &GenericResponse{Success: true, Status: "deleted"},
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryError: errors.New("asd"), deletedImage: data.ImageEntry{ImageName: "image", Format: "png", Adder: "fakeUser"}},
+	}}
 
 	for index, c := range cases {
 		run(index+1, c, t)
@@ -0,0 +1,80 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"time"
+)
+
+// checkExpiry makes sure that the given image hasn't expired. If it has, 410 Gone is sent to the given
+// ResponseWriter. Expired images are removed by ExpireImages, so they only exist for a short while.
+func checkExpiry(w http.ResponseWriter, img data.ImageEntry) bool {
+	if img.Expired(time.Now()) {
+		w.WriteHeader(http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// countView increments the view count of images that have a view limit. If the image doesn't have views left, 410
+// Gone is sent to the given ResponseWriter. The ETag and modification time are those of the file being sent, as
+// HEAD requests and requests that get 304 Not Modified don't count as views.
+func countView(w http.ResponseWriter, r *http.Request, img data.ImageEntry, etag string, modified time.Time) bool {
+	if img.MaxViews == 0 || r.Method == "HEAD" {
+		return true
+	}
+	// Every request is a view, so the image must not be cached anywhere.
+	w.Header().Set("Cache-Control", "private, no-store")
+	if notModified(r, etag, modified) {
+		return true
+	}
+	// Only full responses count as views, as the image could otherwise be downloaded in parts with a single view.
+	r.Header.Del("Range")
+	ok, err := database.AddView(img.ImageName)
+	if err != nil {
+		log.Errorf("Failed to count view of %[2]s requested by %[1]s: %[3]s", getIP(r), img.ImageName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	} else if !ok {
+		w.WriteHeader(http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// ExpireImages periodically removes images that have expired or have been viewed the maximum number of times.
+func ExpireImages() {
+	for {
+		images, err := database.QueryExpired(time.Now().Unix())
+		if err != nil {
+			log.Errorf("Failed to find expired images: %[1]s", err)
+		}
+		for _, img := range images {
+			err = removeImage(img)
+			if err != nil {
+				log.Errorf("Failed to remove expired image %[1]s: %[2]s", img.ImageName, err)
+			} else {
+				log.Debugf("Removed expired image %[1]s", img.ImageName)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,117 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"errors"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetExpired(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Hash: fakeHash}
+	expired := image
+	expired.ExpiresAt = time.Now().Unix() - 10
+	viewed := image
+	viewed.MaxViews, viewed.Views = 2, 2
+	limited := image
+	limited.MaxViews, limited.Views = 2, 1
+	files := fakeStore{files: map[string]string{image.FileName(): "fakeImageData"}}
+	assertNoStore := func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+		assertFile("image/png", "fakeImageData")(index, c, t, recorder)
+		if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "private, no-store" {
+			t.Errorf("[%s #%d] Cache control didn't match! Expected private, no-store, but received %s", c.path, index, cacheControl)
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/fakeImage", assert: defaultAssert,
+		status:   http.StatusGone,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: expired, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: defaultAssert,
+		status:   http.StatusGone,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: expired, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/thumb/fakeImage", assert: defaultAssert,
+		status:   http.StatusGone,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: expired},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: defaultAssert,
+		status:   http.StatusGone,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: viewed, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: assertNoStore,
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: limited, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: defaultAssert,
+		status:   http.StatusInternalServerError,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: limited, exactQuery: true, viewError: errors.New("fakeError")},
+		store:    files,
+	}, {
+		// Revalidating doesn't count as a view, so the view error isn't reached.
+		action: "GET", path: "/fakeImage.png", assert: defaultAssert,
+		headers:  map[string]string{"If-None-Match": imageETag(image, "")},
+		status:   http.StatusNotModified,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: limited, exactQuery: true, viewError: errors.New("fakeError")},
+		store:    files,
+	}, {
+		action: "GET", path: "/thumb/fakeImage", assert: defaultAssert,
+		headers:  map[string]string{"If-None-Match": imageETag(image, "")},
+		status:   http.StatusNotModified,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: limited, viewError: errors.New("fakeError")},
+		store:    files,
+	}, {
+		action: "GET", path: "/thumb/fakeImage", assert: defaultAssert,
+		status:   http.StatusInternalServerError,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: limited, viewError: errors.New("fakeError")},
+		store:    files,
+	}, {
+		// Range requests get the whole image, as every response counts as a view.
+		action: "GET", path: "/fakeImage.png", assert: assertNoStore,
+		headers:  map[string]string{"Range": "bytes=0-3"},
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: limited, exactQuery: true},
+		store:    files,
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
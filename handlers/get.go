@@ -18,56 +18,193 @@
 package handlers
 
 import (
-	"io/ioutil"
+	"fmt"
 	"maunium.net/go/mauimageserver/data"
 	log "maunium.net/go/maulogger"
+	"mime"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// Get handles get requests
+// Get handles get requests.
+//
+// /{name} is the image page, or the image itself if the Accept header prefers images over HTML or the raw query
+// parameter is set. /{name}.{ext} is always the image itself, and /{name}/download sends the image as a download.
 func Get(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.Header().Add("Allow", "GET")
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 	path := r.URL.Path[1:]
+	download := strings.HasSuffix(path, "/download")
+	path = strings.TrimSuffix(path, "/download")
 
 	img, err := database.Query(path)
 	if err == nil {
+		// The same address can be either the page or the image, so caches must check the Accept header.
+		w.Header().Add("Vary", "Accept")
+	}
+	if err == nil && (!checkView(w, r, img) || !checkExpiry(w, img)) {
+		return
+	} else if err == nil && !download && !wantsRaw(r) {
+		if !unlocked(r, img) {
+			sendLockedPage(w, r, img, "")
+			return
+		}
 		date := time.Unix(img.Timestamp, 0).Format(config.DateFormat)
+		// Thumbnails are never larger than the original, so this falls back to the original if necessary.
+		thumbnailAddr := thumbnailURL(img.ImageName, true)
+		if len(thumbnailAddr) > 0 {
+			thumbnailAddr += signatureQuery(r.URL.Query(), "&")
+		}
+		pageURL := publicURL(r) + "/" + url.PathEscape(img.ImageName)
+		imageURL, oEmbedURL := pageURL+"."+img.Format, publicURL(r)+"/oembed?format=json&url="+url.QueryEscape(pageURL)
 		r.URL.Path = r.URL.Path + "." + img.Format
+		if len(thumbnailAddr) == 0 {
+			// Thumbnails are disabled, so the page shows the original image.
+			thumbnailAddr = r.URL.String()
+		}
+		if img.MaxViews > 0 {
+			// Every request for the image counts as a view, so don't load the thumbnail too, and don't let link
+			// previews use up views.
+			thumbnailAddr = r.URL.String()
+			imageURL, oEmbedURL = "", ""
+		}
 		data.ImagePage{
-			ImageName: img.ImageName,
-			ImageAddr: r.URL.String(),
-			Uploader:  img.Adder,
-			Client:    img.Client,
-			Date:      date,
-			Index:     strconv.Itoa(img.ID),
+			ImageName:     img.ImageName,
+			ImageAddr:     r.URL.String(),
+			ThumbnailAddr: thumbnailAddr,
+			Uploader:      img.Adder,
+			Client:        img.Client,
+			Date:          date,
+			Index:         strconv.Itoa(img.ID),
+			Width:         img.Width,
+			Height:        img.Height,
+			Size:          formatSize(img.Bytes),
+			SHA256:        img.Hash,
+			PageURL:       pageURL,
+			ImageURL:      imageURL,
+			OEmbedURL:     oEmbedURL,
+			MimeType:      img.ContentType(),
 		}.Send(w)
 		return
 	}
 
-	imgData, err := ioutil.ReadFile(config.ImageLocation + r.URL.Path)
+	// Images are stored by hash, so the file name has to be looked up from the database. Images uploaded before
+	// deduplication are still stored by name and extension. Files are never served without an image entry, as the
+	// access checks depend on it.
+	if err != nil {
+		img, err = database.Query(strings.Split(path, ".")[0])
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if !checkView(w, r, img) || !checkExpiry(w, img) {
+			return
+		}
+	}
+	if !checkPassword(w, r, img) {
+		return
+	}
+	file, err := store.Open(img.FileName())
 	if err != nil {
 		log.Errorf("Failed to read image at %[2]s requested by %[1]s: %[3]s", getIP(r), path, err)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	defer file.Close()
+
+	if isResizeRequest(r.URL.Query()) {
+		params, err := parseResizeParams(r.URL.Query(), img.MimeType)
+		if err != nil {
+			log.Debugf("%[1]s sent an invalid resize request for %[2]s: %[3]s", getIP(r), img.ImageName, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if !countView(w, r, img, imageETag(img, params.String()), imageModified(img)) {
+			return
+		}
+		serveResized(w, r, img, file, params)
+		return
+	}
 
-	split := strings.Split(path, ".")
-	if len(split) > 0 {
-		img, err = database.Query(split[0])
-		if err == nil && len(img.Format) > 0 {
-			w.Header().Set("Content-type", "image/"+img.Format)
-		} else if len(split) > 1 {
-			w.Header().Set("Content-type", "image/"+split[len(split)-1])
+	if !countView(w, r, img, imageETag(img, ""), imageModified(img)) {
+		return
+	}
+	fileName := img.ImageName + "." + img.Format
+	if download {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	}
+	serveImage(w, r, file, img.ContentType(), imageETag(img, ""), imageModified(img))
+}
+
+// wantsRaw checks if a request to the image page should get the image itself instead. That's the case if the raw
+// query parameter is true, if the query has resize parameters or if the Accept header prefers images over HTML.
+func wantsRaw(r *http.Request) bool {
+	query := r.URL.Query()
+	if raw, err := strconv.ParseBool(query.Get("raw")); err == nil && raw {
+		return true
+	} else if isResizeRequest(query) {
+		return true
+	}
+	html, image := acceptQuality(r.Header.Get("Accept"))
+	return image > html
+}
+
+// acceptQuality returns the quality values that the given Accept header gives to HTML and images. The most specific
+// matching media range decides the quality, e.g. text/html;q=0 overrides */*.
+func acceptQuality(accept string) (html, image float64) {
+	var htmlSpecificity, imageSpecificity int
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		var specificity int
+		switch {
+		case mediaType == "*/*":
+			specificity = 1
+		case mediaType == "text/*" || mediaType == "image/*":
+			specificity = 2
+		case mediaType == "text/html" || strings.HasPrefix(mediaType, "image/"):
+			specificity = 3
+		default:
+			continue
+		}
+		if mediaType == "*/*" || strings.HasPrefix(mediaType, "text/") {
+			if specificity > htmlSpecificity || (specificity == htmlSpecificity && quality > html) {
+				html, htmlSpecificity = quality, specificity
+			}
+		}
+		if mediaType == "*/*" || strings.HasPrefix(mediaType, "image/") {
+			if specificity > imageSpecificity || (specificity == imageSpecificity && quality > image) {
+				image, imageSpecificity = quality, specificity
+			}
 		}
 	}
+	return
+}
 
-	w.Write(imgData)
+// formatSize formats the given number of bytes in a human-readable way. Unknown sizes are formatted as an empty string.
+func formatSize(bytes int64) string {
+	if bytes <= 0 {
+		return ""
+	} else if bytes < 1024 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(1024), 0
+	for n := bytes / 1024; n >= 1024; n /= 1024 {
+		div *= 1024
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
@@ -0,0 +1,333 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetContentType(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	// Images uploaded before the format was derived from the content may have the wrong extension.
+	mismatched := data.ImageEntry{ImageName: "fakeImage", Format: "gif", MimeType: "png", Hash: fakeHash}
+	legacy := data.ImageEntry{ImageName: "fakeImage", Format: "gif", Hash: fakeHash}
+	cases := []test{{
+		action: "GET", path: "/fakeImage.gif",
+		assert:   assertFile("image/png", "image"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: mismatched, exactQuery: true},
+		store:    fakeStore{files: map[string]string{mismatched.FileName(): "image"}},
+	}, {
+		action: "GET", path: "/fakeImage.gif",
+		assert:   assertFile("image/gif", "image"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: legacy, exactQuery: true},
+		store:    fakeStore{files: map[string]string{legacy.FileName(): "image"}},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestGetBlob(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	// Files in the store must never be served without the access checks of the image entry.
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: fakeHash,
+		Hidden: true, Visibility: data.VisibilityPrivate}
+	files := fakeStore{files: map[string]string{image.FileName(): "image", image.ThumbnailName(256): "thumbnail"}}
+	cases := []test{{
+		action: "GET", path: "/" + image.FileName(), assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/" + image.ThumbnailName(256), assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/" + image.FileName() + "/download", assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestGetSVG(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "svg", MimeType: "svg+xml", Hash: fakeHash}
+	files := fakeStore{files: map[string]string{image.FileName(): "<svg></svg>"}}
+	assertHeaders := func(disposition string) func(int, test, *testing.T, *httptest.ResponseRecorder) {
+		return func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			assertFile("image/svg+xml", "<svg></svg>")(index, c, t, recorder)
+			if csp := recorder.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+				t.Errorf("[%s #%d] Content security policy didn't match! Expected sandbox, but received %s", c.path, index, csp)
+			}
+			if received := recorder.Header().Get("Content-Disposition"); received != disposition {
+				t.Errorf("[%s #%d] Content disposition didn't match! Expected %s, but received %s", c.path, index, disposition, received)
+			}
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/fakeImage.svg", assert: assertHeaders(""),
+		status:   http.StatusOK,
+		config:   &data.Configuration{SVG: "sanitize"},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.svg", assert: assertHeaders("attachment"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{SVG: "attachment"},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		// Thumbnails of SVG images are the original image.
+		action: "GET", path: "/thumb/fakeImage", assert: assertHeaders("attachment"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{SVG: "attachment"},
+		database: fakeDatabase{queryImage: image},
+		store:    files,
+	}, {
+		// The unsanitized file must only be served through the image, which sets the headers above.
+		action: "GET", path: "/" + image.FileName(), assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{SVG: "attachment"},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestGetCaching(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Hash: fakeHash, Timestamp: 1500000000}
+	files := fakeStore{files: map[string]string{image.FileName(): "fakeImageData"}}
+	assertCached := func(status int, body, cacheControl string) func(int, test, *testing.T, *httptest.ResponseRecorder) {
+		return func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			if recorder.Code != status {
+				t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, status, recorder.Code)
+			} else if recorder.Body.String() != body {
+				t.Errorf("[%s #%d] Body didn't match! Expected %q, but received %q", c.path, index, body, recorder.Body.String())
+			}
+			expected := map[string]string{
+				"ETag":          `"` + fakeHash + `"`,
+				"Last-Modified": "Fri, 14 Jul 2017 02:40:00 GMT",
+				"Cache-Control": cacheControl,
+			}
+			if status == http.StatusNotModified {
+				// Last-Modified is redundant with an ETag in a 304 response, so it's not sent.
+				delete(expected, "Last-Modified")
+			}
+			for header, value := range expected {
+				if received := recorder.Header().Get(header); received != value {
+					t.Errorf("[%s #%d] %s didn't match! Expected %s, but received %s", c.path, index, header, value, received)
+				}
+			}
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/fakeImage.png", assert: assertCached(http.StatusOK, "fakeImageData", defaultCacheControl),
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "HEAD", path: "/fakeImage.png", assert: assertCached(http.StatusOK, "", defaultCacheControl),
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: assertCached(http.StatusOK, "fakeImageData", "no-cache"),
+		config:   &data.Configuration{CacheControl: "no-cache"},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: assertCached(http.StatusNotModified, "", defaultCacheControl),
+		headers:  map[string]string{"If-None-Match": `"` + fakeHash + `"`},
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: assertCached(http.StatusNotModified, "", defaultCacheControl),
+		headers:  map[string]string{"If-Modified-Since": "Sat, 15 Jul 2017 00:00:00 GMT"},
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: assertCached(http.StatusPartialContent, "Image", defaultCacheControl),
+		headers:  map[string]string{"Range": "bytes=4-8"},
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestGetNegotiation(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Hash: fakeHash}
+	files := fakeStore{files: map[string]string{image.FileName(): "fakeImageData"}}
+	assertRaw := func(disposition string) func(int, test, *testing.T, *httptest.ResponseRecorder) {
+		return func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			assertFile("image/png", "fakeImageData")(index, c, t, recorder)
+			if received := recorder.Header().Get("Content-Disposition"); received != disposition {
+				t.Errorf("[%s #%d] Content disposition didn't match! Expected %s, but received %s", c.path, index, disposition, received)
+			}
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/fakeImage?raw=1", assert: assertRaw(""),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage", assert: assertRaw(""),
+		headers:  map[string]string{"Accept": "image/webp,image/*;q=0.8,*/*;q=0.5"},
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage/download", assert: assertRaw(`attachment; filename=fakeImage.png`),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestAcceptQuality(t *testing.T) {
+	cases := []struct {
+		accept      string
+		html, image float64
+	}{
+		{"", 0, 0},
+		{"*/*", 1, 1},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8", 1, 1},
+		{"image/avif,image/webp,image/*,*/*;q=0.8", 0.8, 1},
+		{"text/html;q=0, */*", 0, 1},
+		{"image/*;q=0.5, text/*;q=0.4", 0.4, 0.5},
+		{"invalid;;, image/png", 0, 1},
+	}
+	for index, c := range cases {
+		html, image := acceptQuality(c.accept)
+		if html != c.html || image != c.image {
+			t.Errorf("[#%d] Expected %v/%v for %q, but received %v/%v", index+1, c.html, c.image, c.accept, html, image)
+		}
+	}
+}
+
+func TestGetPage(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	err := data.LoadTemplates("../image.html")
+	if err != nil {
+		t.Fatalf("Failed to load template: %s", err)
+	}
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: fakeHash, Width: 20, Height: 10}
+	limited := image
+	limited.MaxViews = 1
+	assertPage := func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+		if recorder.Code != c.status {
+			t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, c.status, recorder.Code)
+			return
+		}
+		for _, tag := range []string{
+			`<meta property="og:url" content="https://i.example.com/fakeImage">`,
+			`<meta property="og:image" content="https://i.example.com/fakeImage.png">`,
+			`<meta property="og:image:type" content="image/png">`,
+			`<meta property="og:image:width" content="20">`,
+			`<meta name="twitter:card" content="summary_large_image">`,
+			`href="https://i.example.com/oembed?format=json&amp;url=https%3A%2F%2Fi.example.com%2FfakeImage"`,
+		} {
+			if !strings.Contains(recorder.Body.String(), tag) {
+				t.Errorf("[%s #%d] Page doesn't contain %s", c.path, index, tag)
+			}
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/fakeImage", assert: assertPage,
+		headers:  map[string]string{"Accept": "text/html,image/webp,*/*;q=0.8"},
+		status:   http.StatusOK,
+		config:   &data.Configuration{PublicURL: "https://i.example.com"},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		// The public URL is guessed from the request if it's not configured.
+		action: "GET", path: "http://i.example.com/fakeImage", assert: assertPage,
+		status:   http.StatusOK,
+		config:   &data.Configuration{TrustHeaders: true},
+		headers:  map[string]string{"X-Forwarded-Proto": "https"},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		// The page shows the original image if thumbnails are disabled.
+		action: "GET", path: "/fakeImage", assert: func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			assertPage(index, c, t, recorder)
+			if !strings.Contains(recorder.Body.String(), `src="/fakeImage.png"`) {
+				t.Errorf("[%s #%d] Page doesn't show the original image:\n%s", c.path, index, recorder.Body.String())
+			}
+		},
+		status:   http.StatusOK,
+		config:   &data.Configuration{PublicURL: "https://i.example.com", ThumbnailSizes: []int{}},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		// Link previews of images with a view limit would use up views.
+		action: "GET", path: "/fakeImage", assert: func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			if body := recorder.Body.String(); recorder.Code != c.status || strings.Contains(body, "og:image") ||
+				strings.Contains(body, "twitter:image") || strings.Contains(body, "/oembed") {
+				t.Errorf("[%s #%d] Page of an image with a view limit has a link preview:\n%s", c.path, index, body)
+			}
+		},
+		status:   http.StatusOK,
+		config:   &data.Configuration{PublicURL: "https://i.example.com"},
+		database: fakeDatabase{queryImage: limited, exactQuery: true},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
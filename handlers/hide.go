@@ -19,6 +19,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"maunium.net/go/mauimageserver/data"
 	log "maunium.net/go/maulogger"
 	"net/http"
 )
@@ -27,8 +28,10 @@ import (
 type HideForm struct {
 	ImageName string `json:"image-name"`
 	Hidden    bool   `json:"hidden"`
-	Username  string `json:"username"`
-	AuthToken string `json:"auth-token"`
+	// Visibility overrides Hidden if set. Hidden means unlisted.
+	Visibility string `json:"visibility"`
+	Username   string `json:"username"`
+	AuthToken  string `json:"auth-token"`
 }
 
 // Hide handles hide/unhide requests
@@ -46,7 +49,8 @@ func Hide(w http.ResponseWriter, r *http.Request) {
 	// Decode the payload.
 	err := decoder.Decode(&hfr)
 	// Check if there was an error decoding.
-	if err != nil || len(hfr.ImageName) == 0 || len(hfr.Username) == 0 || len(hfr.AuthToken) == 0 {
+	if err != nil || len(hfr.ImageName) == 0 || len(hfr.Username) == 0 || len(hfr.AuthToken) == 0 ||
+		(len(hfr.Visibility) > 0 && !data.ValidVisibility(hfr.Visibility)) {
 		log.Debugf("%[1]s sent an invalid hide request.", ip)
 		w.WriteHeader(http.StatusBadRequest)
 		return
@@ -81,7 +85,13 @@ func Hide(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = database.SetHidden(hfr.ImageName, hfr.Hidden)
+	if len(hfr.Visibility) == 0 {
+		hfr.Visibility = data.VisibilityPublic
+		if hfr.Hidden {
+			hfr.Visibility = data.VisibilityUnlisted
+		}
+	}
+	err = database.SetVisibility(hfr.ImageName, hfr.Visibility)
 	if err != nil {
 		log.Warnf("Error changing hide status of %[4]s (requested by %[1]s@%[2]s): %[3]s", hfr.Username, ip, err, hfr.ImageName)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -89,13 +99,13 @@ func Hide(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var hid string
-	if hfr.Hidden {
+	if hfr.Visibility != data.VisibilityPublic {
 		hid = "hidden"
 	} else {
 		hid = "unhidden"
 	}
 
-	log.Debugf("%[1]s@%[2]s successfully changed hidden status to %[4]t of the image with the name %[3]s.", hfr.Username, ip, hfr.ImageName, hfr.Hidden)
+	log.Debugf("%[1]s@%[2]s successfully changed visibility to %[4]s of the image with the name %[3]s.", hfr.Username, ip, hfr.ImageName, hfr.Visibility)
 	output(w, GenericResponse{
 		Success:        true,
 		Status:         hid,
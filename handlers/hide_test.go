@@ -92,6 +92,22 @@ func TestHide(t *testing.T) {
 		config:   &data.Configuration{ImageLocation: "/tmp"},
 		auth:     fakeAuth{},
 		database: fakeDatabase{imageOwner: "fakeUser"},
+	}, {
+		action: "POST", path: "/hide", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"visibility\": \"private\"}",
+		status:   http.StatusAccepted,
+		expected: &GenericResponse{Success: true, Status: "hidden"},
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{imageOwner: "fakeUser"},
+	}, {
+		action: "POST", path: "/hide", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\",\"visibility\": \"secret\"}",
+		status:   http.StatusBadRequest,
+		expected: nil,
+		config:   &data.Configuration{ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{imageOwner: "fakeUser"},
 	}}
 
 	for index, c := range cases {
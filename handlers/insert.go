@@ -18,12 +18,24 @@
 package handlers
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"maunium.net/go/mauimageserver/data"
+	"maunium.net/go/mauimageserver/imaging"
 	log "maunium.net/go/maulogger"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // InsertForm is the form for inserting images into the system. Requirement of AuthToken is configurable.
@@ -35,34 +47,267 @@ type InsertForm struct {
 	Username    string `json:"username"`
 	AuthToken   string `json:"auth-token"`
 	Hidden      bool   `json:"hidden"`
+	// Visibility is public, unlisted or private. Defaults to unlisted if Hidden is true and public otherwise.
+	Visibility string `json:"visibility"`
+	// KeepMetadata disables metadata stripping for this upload. Only authenticated users can use it.
+	KeepMetadata bool `json:"keep-metadata"`
+	// ExpiresAt is the unix timestamp after which the image is removed. TTL is the same in seconds from the upload.
+	// Only one of them can be set.
+	ExpiresAt int64 `json:"expires-at"`
+	TTL       int64 `json:"ttl"`
+	// MaxViews is the number of times the image can be viewed before it's removed.
+	MaxViews int `json:"max-views"`
+	// Password is required to view the image. It's replaced with passwordHash by authenticateInsert.
+	Password     string `json:"password"`
+	passwordHash string
 }
 
-// Insert handles insert requests
+// Insert handles insert requests.
+//
+// The image can be sent as base64 in a JSON body (POST /insert), as the "image" file of a multipart/form-data
+// body (POST /insert) or as the raw request body (PUT /insert/{name}). Multipart form values must come before
+// the file, as the file is streamed into a temporary file. Raw uploads read the other fields from headers.
 func Insert(w http.ResponseWriter, r *http.Request) {
 	var ip = getIP(r)
-	if r.Method != "POST" {
-		w.Header().Add("Allow", "POST")
+	var ifr InsertForm
+	var image io.Reader
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/insert/") {
+		limitBody(w, r, 0)
+		ifr, image, err = readRawInsert(r)
+	} else if r.Method == "POST" && mediaType == "multipart/form-data" {
+		// Leave some room for the other form values and multipart headers.
+		limitBody(w, r, 64*1024)
+		ifr, image, err = readMultipartInsert(r)
+	} else if r.Method == "POST" {
+		// Base64 makes the image 4/3 of the original size.
+		limitBody(w, r, config.MaxUploadSize/3+64*1024)
+		ifr, image, err = readJSONInsert(r)
+	} else {
+		w.Header().Add("Allow", "POST, PUT")
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if isTooLarge(err) {
+		log.Debugf("%[1]s tried to upload an image that is too large.", ip)
+		outputTooLarge(w, config.MaxUploadSize)
+		return
+	} else if err != nil {
+		log.Debugf("%[1]s sent an invalid insert request.", ip)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	insertImage(w, ip, ifr, image)
+}
+
+// limitBody limits the size of the request body to the maximum upload size plus the given overhead.
+func limitBody(w http.ResponseWriter, r *http.Request, overhead int64) {
+	if config.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, config.MaxUploadSize+overhead)
+	}
+}
+
+// errTooLarge is returned by spoolImage if the image is larger than the maximum upload size.
+var errTooLarge = errors.New("image too large")
+
+func isTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return err == errTooLarge || errors.As(err, &maxBytesErr)
+}
+
+func outputTooLarge(w http.ResponseWriter, maxSize int64) {
+	output(w, GenericResponse{
+		Success:        false,
+		Status:         "too-large",
+		StatusReadable: fmt.Sprintf("The uploaded image is too large. The maximum size is %d bytes.", maxSize),
+	}, http.StatusRequestEntityTooLarge)
+}
+
+// spoolImage copies the image from the given reader into a temporary file, which the caller must remove.
+// The size and the hex-encoded SHA-256 hash of the image are returned with the file.
+func spoolImage(image io.Reader) (*os.File, int64, string, error) {
+	file, err := ioutil.TempFile("", "mis-upload-")
+	if err != nil {
+		return nil, 0, "", err
+	}
+	if config.MaxUploadSize > 0 {
+		image = io.LimitReader(image, config.MaxUploadSize+1)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), image)
+	if err == nil && config.MaxUploadSize > 0 && size > config.MaxUploadSize {
+		err = errTooLarge
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, "", err
+	}
+	return file, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func readJSONInsert(r *http.Request) (ifr InsertForm, image io.Reader, err error) {
 	// Create a json decoder for the payload.
 	decoder := json.NewDecoder(r.Body)
-	var ifr InsertForm
 	// Decode the payload.
-	err := decoder.Decode(&ifr)
+	err = decoder.Decode(&ifr)
 	// Check if there was an error decoding.
-	if err != nil || len(ifr.Image) == 0 {
-		log.Debugf("%[1]s sent an invalid insert request.", ip)
-		w.WriteHeader(http.StatusBadRequest)
+	if err != nil {
+		return
+	} else if len(ifr.Image) == 0 {
+		err = errors.New("no image")
 		return
 	}
+	return ifr, base64Reader{base64.NewDecoder(base64.StdEncoding, strings.NewReader(ifr.Image))}, nil
+}
+
+// invalidEncoding is the error returned by base64Reader when the input isn't valid base64.
+type invalidEncoding struct {
+	error
+}
+
+// base64Reader wraps a base64 decoder so that decoding errors can be told apart from other errors.
+type base64Reader struct {
+	io.Reader
+}
+
+func (reader base64Reader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = invalidEncoding{err}
+	}
+	return n, err
+}
 
+func readMultipartInsert(r *http.Request) (ifr InsertForm, image io.Reader, err error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return
+	}
+	for {
+		var part *multipart.Part
+		part, err = reader.NextPart()
+		if err != nil {
+			// Either the body is invalid or it ended without an image.
+			return
+		}
+		if part.FormName() == "image" {
+			return ifr, part, nil
+		}
+		var value []byte
+		value, err = ioutil.ReadAll(io.LimitReader(part, 1024))
+		if err != nil {
+			return
+		}
+		switch part.FormName() {
+		case "image-name":
+			ifr.ImageName = string(value)
+		case "image-format":
+			ifr.ImageFormat = string(value)
+		case "client-name":
+			ifr.Client = string(value)
+		case "username":
+			ifr.Username = string(value)
+		case "auth-token":
+			ifr.AuthToken = string(value)
+		case "hidden":
+			ifr.Hidden, _ = strconv.ParseBool(string(value))
+		case "visibility":
+			ifr.Visibility = string(value)
+		case "keep-metadata":
+			ifr.KeepMetadata, _ = strconv.ParseBool(string(value))
+		case "expires-at":
+			ifr.ExpiresAt, _ = strconv.ParseInt(string(value), 10, 64)
+		case "ttl":
+			ifr.TTL, _ = strconv.ParseInt(string(value), 10, 64)
+		case "max-views":
+			ifr.MaxViews, _ = strconv.Atoi(string(value))
+		case "password":
+			ifr.Password = string(value)
+		}
+	}
+}
+
+func readRawInsert(r *http.Request) (ifr InsertForm, image io.Reader, err error) {
+	ifr.ImageName = r.URL.Path[len("/insert/"):]
+	ifr.ImageFormat = r.Header.Get("X-Image-Format")
+	if dot := strings.LastIndexByte(ifr.ImageName, '.'); dot > 0 {
+		// Allow giving the format as the extension of the name, e.g. PUT /insert/name.png
+		if len(ifr.ImageFormat) == 0 {
+			ifr.ImageFormat = ifr.ImageName[dot+1:]
+		}
+		ifr.ImageName = ifr.ImageName[:dot]
+	}
+	ifr.Client = r.Header.Get("X-Client-Name")
+	ifr.Username = r.Header.Get("X-Username")
+	ifr.AuthToken = r.Header.Get("X-Auth-Token")
+	ifr.Hidden, _ = strconv.ParseBool(r.Header.Get("X-Hidden"))
+	ifr.Visibility = r.Header.Get("X-Visibility")
+	ifr.KeepMetadata, _ = strconv.ParseBool(r.Header.Get("X-Keep-Metadata"))
+	ifr.ExpiresAt, _ = strconv.ParseInt(r.Header.Get("X-Expires-At"), 10, 64)
+	ifr.TTL, _ = strconv.ParseInt(r.Header.Get("X-TTL"), 10, 64)
+	ifr.MaxViews, _ = strconv.Atoi(r.Header.Get("X-Max-Views"))
+	ifr.Password = r.Header.Get("X-Password")
+	return ifr, r.Body, nil
+}
+
+// insertImage authenticates the uploader and stores the image read from the given reader.
+func insertImage(w http.ResponseWriter, ip string, ifr InsertForm, image io.Reader) {
+	if !authenticateInsert(w, ip, &ifr) {
+		return
+	}
+	saveImage(w, ip, ifr, image)
+}
+
+// authenticateInsert fills out the default values of the given InsertForm and checks the authentication of the
+// uploader. If the uploader isn't logged in, the username is set to "anonymous". If authentication fails, an error
+// is sent to the given ResponseWriter and false is returned.
+func authenticateInsert(w http.ResponseWriter, ip string, ifr *InsertForm) bool {
 	// Fill out all non-necessary unfilled values.
-	if len(ifr.ImageName) == 0 {
-		ifr.ImageName = ImageName(5)
+	if len(ifr.Visibility) == 0 {
+		ifr.Visibility = data.VisibilityPublic
+		if ifr.Hidden {
+			ifr.Visibility = data.VisibilityUnlisted
+		}
+	} else if !data.ValidVisibility(ifr.Visibility) {
+		log.Debugf("%[1]s tried to upload an image with the unknown visibility %[2]s.", ip, ifr.Visibility)
+		output(w, GenericResponse{
+			Success:        false,
+			Status:         "invalid-visibility",
+			StatusReadable: "The visibility must be public, unlisted or private.",
+		}, http.StatusBadRequest)
+		return false
 	}
-	if len(ifr.ImageFormat) == 0 {
-		ifr.ImageFormat = "png"
+	if ifr.ExpiresAt < 0 || ifr.TTL < 0 || ifr.MaxViews < 0 || (ifr.ExpiresAt > 0 && ifr.TTL > 0) ||
+		(ifr.ExpiresAt > 0 && ifr.ExpiresAt <= time.Now().Unix()) {
+		log.Debugf("%[1]s tried to upload an image with an invalid expiry.", ip)
+		output(w, GenericResponse{
+			Success:        false,
+			Status:         "invalid-expiry",
+			StatusReadable: "The expiry time must be in the future, and only one of expires-at and ttl can be set.",
+		}, http.StatusBadRequest)
+		return false
+	}
+	if len(ifr.Password) > 72 {
+		// bcrypt ignores everything after the first 72 bytes.
+		log.Debugf("%[1]s tried to upload an image with a too long password.", ip)
+		output(w, GenericResponse{
+			Success:        false,
+			Status:         "invalid-password",
+			StatusReadable: "The password can't be longer than 72 bytes.",
+		}, http.StatusBadRequest)
+		return false
+	}
+	if len(ifr.ImageName) == 0 {
+		if ifr.Visibility == data.VisibilityPublic {
+			ifr.ImageName = ImageName(5)
+		} else {
+			ifr.ImageName = ImageName(unlistedNameLength())
+		}
 	}
 	if len(ifr.Client) == 0 {
 		ifr.Client = "Unknown Client"
@@ -78,13 +323,23 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 				Status:         "not-logged-in",
 				StatusReadable: "This MIS server requires authentication. Please log in or register.",
 			}, http.StatusUnauthorized)
-			return
+			return false
+		}
+		if ifr.Visibility == data.VisibilityPrivate {
+			// Nobody would be able to view a private anonymous image.
+			log.Debugf("%[1]s tried to upload a private image without authentication.", ip)
+			output(w, GenericResponse{
+				Success:        false,
+				Status:         "not-logged-in",
+				StatusReadable: "Uploading private images requires authentication. Please log in or register.",
+			}, http.StatusUnauthorized)
+			return false
 		}
 		// The user is not logged in, but login is not required, set username to "anonymous"
 		ifr.Username = "anonymous"
 	} else {
 		// Username and authentication token supplied, check them.
-		err = auth.CheckAuthToken(ifr.Username, []byte(ifr.AuthToken))
+		err := auth.CheckAuthToken(ifr.Username, []byte(ifr.AuthToken))
 		if err != nil {
 			log.Debugf("%[1]s tried to authenticate as %[2]s with the wrong token.", ip, ifr.Username)
 			output(w, GenericResponse{
@@ -92,39 +347,74 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 				Status:         "invalid-authtoken",
 				StatusReadable: "Your authentication token was incorrect. Please try logging in again.",
 			}, http.StatusUnauthorized)
-			return
+			return false
 		}
 	}
 
-	// If the image already exists, make sure that the uploader is the owner of the image.
-	var replace = false
-	owner := database.GetOwner(ifr.ImageName)
+	if len(ifr.Password) > 0 {
+		// The password is hashed right away, so that it's never stored in plain text, not even in resumable uploads.
+		var err error
+		ifr.passwordHash, err = hashPassword(ifr.Password)
+		ifr.Password = ""
+		if err != nil {
+			log.Errorf("Failed to hash image password from %[1]s@%[2]s: %[3]s", ifr.Username, ip, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return false
+		}
+	}
+	return true
+}
+
+// checkOwner makes sure that the given user is allowed to use the given image name.
+// The first return value is true if the name is already used by the same user.
+// If the name is used by someone else, an error is sent to the given ResponseWriter and false is returned.
+func checkOwner(w http.ResponseWriter, ip, imageName, username string) (replace bool, ok bool) {
+	owner := database.GetOwner(imageName)
 	if len(owner) > 0 {
-		if owner != ifr.Username || ifr.Username == "anonymous" {
+		if owner != username || username == "anonymous" {
 			output(w, GenericResponse{
 				Success:        false,
 				Status:         "already-exists",
 				StatusReadable: "The requested image name is already in use by another user",
 			}, http.StatusForbidden)
-			log.Debugf("%[1]s@%[2]s attempted to override an image uploaded by %[3]s.", ifr.Username, ip, owner)
-			return
+			log.Debugf("%[1]s@%[2]s attempted to override an image uploaded by %[3]s.", username, ip, owner)
+			return false, false
 		}
-		replace = true
+		return true, true
 	}
+	return false, true
+}
 
-	// Decode the base64 image from the JSON request.
-	image, err := base64.StdEncoding.DecodeString(ifr.Image)
-	if err != nil {
-		output(w, GenericResponse{Success: false, Status: "invalid-image-encoding",
-			StatusReadable: "The given image is not properly encoded in base64."}, http.StatusUnsupportedMediaType)
-		log.Errorf("Error while decoding image from %[1]s@%[2]s: %[3]s", ifr.Username, ip, err)
+// saveImage stores the image read from the given reader using the details in the given authenticated InsertForm.
+func saveImage(w http.ResponseWriter, ip string, ifr InsertForm, image io.Reader) {
+	// If the image already exists, make sure that the uploader is the owner of the image.
+	replace, ok := checkOwner(w, ip, ifr.ImageName, ifr.Username)
+	if !ok {
 		return
 	}
 
-	mimeType := http.DetectContentType(image)
+	// Copy the image into a temporary file. This also enforces the maximum upload size for the decoded image.
+	file, size, hash, err := spoolImage(image)
+	if err != nil {
+		if isTooLarge(err) {
+			log.Debugf("%[1]s@%[2]s tried to upload an image that is too large.", ifr.Username, ip)
+			outputTooLarge(w, config.MaxUploadSize)
+		} else if _, ok := err.(invalidEncoding); ok {
+			output(w, GenericResponse{Success: false, Status: "invalid-image-encoding",
+				StatusReadable: "The given image is not properly encoded in base64."}, http.StatusUnsupportedMediaType)
+			log.Errorf("Error while decoding image from %[1]s@%[2]s: %[3]s", ifr.Username, ip, err)
+		} else {
+			log.Errorf("Error while reading image from %[1]s@%[2]s: %[3]s", ifr.Username, ip, err)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
 
+	mimeType := detectType(io.NewSectionReader(file, 0, size))
 	if !strings.HasPrefix(mimeType, "image/") {
-		log.Debugf("%[1]s@%[2]s attempted to upload an image with an incorrect MIME type.", ifr.Username, ip, owner)
+		log.Debugf("%[1]s@%[2]s attempted to upload an image with an incorrect MIME type.", ifr.Username, ip)
 		output(w, GenericResponse{
 			Success:        false,
 			Status:         "invalid-mime",
@@ -132,27 +422,107 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 		}, http.StatusUnsupportedMediaType)
 		return
 	}
+	allowed, ok := allowedType(mimeType)
+	if !ok {
+		log.Debugf("%[1]s@%[2]s attempted to upload a %[3]s image, which is not allowed.", ifr.Username, ip, mimeType)
+		output(w, GenericResponse{
+			Success:        false,
+			Status:         "type-not-allowed",
+			StatusReadable: "Images of the type " + mimeType + " are not allowed on this server.",
+		}, http.StatusUnsupportedMediaType)
+		return
+	} else if allowed.MaxSize > 0 && size > allowed.MaxSize {
+		log.Debugf("%[1]s@%[2]s tried to upload a %[3]s image that is too large.", ifr.Username, ip, mimeType)
+		outputTooLarge(w, allowed.MaxSize)
+		return
+	}
 	mimeType = mimeType[len("image/"):]
 
-	// Write the image to disk.
-	err = ioutil.WriteFile(config.ImageLocation+"/"+ifr.ImageName+"."+ifr.ImageFormat, image, 0644)
+	// The format (i.e. the extension) is always derived from the content. The format sent by the client is only checked.
+	format, ok := canonicalFormat(mimeType, ifr.ImageFormat)
+	if !ok && config.FormatMismatch == "reject" {
+		log.Debugf("%[1]s@%[2]s attempted to upload a %[3]s image with the format %[4]s.", ifr.Username, ip, mimeType, ifr.ImageFormat)
+		output(w, GenericResponse{
+			Success:        false,
+			Status:         "format-mismatch",
+			StatusReadable: "The image format doesn't match the content of the image. The image is a " + format + " file.",
+		}, http.StatusUnsupportedMediaType)
+		return
+	}
+	ifr.ImageFormat = format
+
+	var filter func(w io.Writer, r io.ReadSeeker) error
+	if mimeType == "svg+xml" && svgPolicy() == "sanitize" {
+		filter = func(w io.Writer, r io.ReadSeeker) error {
+			return imaging.SanitizeSVG(w, r)
+		}
+	} else if config.StripMetadata && imaging.CanStripMetadata(mimeType) && !(ifr.KeepMetadata && ifr.Username != "anonymous") {
+		filter = func(w io.Writer, r io.ReadSeeker) error {
+			return imaging.StripMetadata(w, r, mimeType)
+		}
+	}
+	if filter != nil {
+		filtered, filteredSize, filteredHash, err := filterImage(file, filter)
+		if err != nil {
+			log.Debugf("Failed to process image uploaded by %[1]s@%[2]s: %[3]s", ifr.Username, ip, err)
+			output(w, GenericResponse{
+				Success:        false,
+				Status:         "invalid-image",
+				StatusReadable: "The uploaded image is malformed.",
+			}, http.StatusUnsupportedMediaType)
+			return
+		}
+		defer os.Remove(filtered.Name())
+		defer filtered.Close()
+		file, size, hash = filtered, filteredSize, filteredHash
+	}
+
+	// Unknown formats just won't have dimensions, so errors are ignored.
+	width, height, _ := imaging.Dimensions(io.NewSectionReader(file, 0, size))
+
+	// Images are stored by their hash, so uploading the same image many times only stores it once.
+	created, err := storeBlob(hash, size, file)
 	if err != nil {
 		log.Errorf("Error while saving image from %[1]s@%[2]s: %[3]s", ifr.Username, ip, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	log.Debugf("Saved %[1]d byte image %[2]s (%[5]s) from %[3]s@%[4]s", size, ifr.ImageName, ifr.Username, ip, hash)
 
+	entry := data.ImageEntry{
+		ImageName:    ifr.ImageName,
+		Format:       ifr.ImageFormat,
+		MimeType:     mimeType,
+		Adder:        ifr.Username,
+		AdderIP:      ip,
+		Client:       ifr.Client,
+		Hidden:       ifr.Visibility != data.VisibilityPublic,
+		Visibility:   ifr.Visibility,
+		Hash:         hash,
+		Width:        width,
+		Height:       height,
+		Bytes:        size,
+		ExpiresAt:    ifr.ExpiresAt,
+		MaxViews:     ifr.MaxViews,
+		PasswordHash: ifr.passwordHash,
+	}
+	if ifr.TTL > 0 {
+		entry.ExpiresAt = time.Now().Unix() + ifr.TTL
+	}
+	if created {
+		generateThumbnails(entry, file)
+	}
 	if !replace {
 		// The image name has not been used. Insert it into the database.
-		err = database.Insert(ifr.ImageName, ifr.ImageFormat, mimeType, ifr.Username, ip, ifr.Client, ifr.Hidden)
+		err = database.Insert(entry)
 		if err != nil {
 			log.Errorf("Error while inserting image from %[1]s@%[2]s into the database: %[3]s", ifr.Username, ip, err)
+			removeImageFile(entry)
 			output(w, GenericResponse{
 				Success:        false,
 				Status:         "database-error",
 				StatusReadable: "An internal server error occurred while attempting to save image information to the database.",
 			}, http.StatusInternalServerError)
-			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		log.Debugf("%[1]s@%[2]s successfully uploaded an image with the name %[3]s (new).", ifr.Username, ip, ifr.ImageName)
@@ -164,9 +534,15 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 		}, http.StatusCreated)
 	} else {
 		// The image name was in use. Update the data in the database.
-		err = database.Update(ifr.ImageName, ifr.ImageFormat, mimeType, ip, ifr.Client, ifr.Hidden)
+		old, err := database.Query(ifr.ImageName)
+		if err != nil {
+			// Replacing an image in the trash restores it.
+			old, _ = database.QueryDeleted(ifr.ImageName)
+		}
+		err = database.Update(entry)
 		if err != nil {
 			log.Errorf("Error while updating data of image from %[1]s@%[2]s into the database: %[3]s", ifr.Username, ip, err)
+			removeImageFile(entry)
 			output(w, GenericResponse{
 				Success:        false,
 				Status:         "database-error",
@@ -174,6 +550,14 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 			}, http.StatusInternalServerError)
 			return
 		}
+		// Release the reference to the previous file. The new image already holds its own reference, so this
+		// doesn't remove the file if the same image was uploaded again.
+		if len(old.ImageName) > 0 {
+			err = removeImageFile(old)
+			if err != nil && !os.IsNotExist(err) {
+				log.Warnf("Error while removing the previous file of %[1]s: %[2]s", ifr.ImageName, err)
+			}
+		}
 		log.Debugf("%[1]s@%[2]s successfully uploaded an image with the name %[3]s (replaced).", ifr.Username, ip, ifr.ImageName)
 		output(w, GenericResponse{
 			Success: true,
@@ -184,3 +568,104 @@ func Insert(w http.ResponseWriter, r *http.Request) {
 		}, http.StatusAccepted)
 	}
 }
+
+// imageExtensions maps the MIME subtypes detected by http.DetectContentType to the file extensions of the type.
+// The first extension is the canonical one.
+var imageExtensions = map[string][]string{
+	"jpeg":    {"jpg", "jpeg", "jpe", "jfif"},
+	"png":     {"png"},
+	"gif":     {"gif"},
+	"webp":    {"webp"},
+	"bmp":     {"bmp", "dib"},
+	"x-icon":  {"ico"},
+	"svg+xml": {"svg"},
+}
+
+// canonicalFormat returns the canonical extension for the given MIME subtype. The second return value is false if the
+// given requested format isn't a valid extension for the type. An empty requested format is always valid.
+func canonicalFormat(mimeType, requested string) (string, bool) {
+	extensions, ok := imageExtensions[mimeType]
+	if !ok {
+		extensions = []string{mimeType}
+	}
+	if len(requested) == 0 {
+		return extensions[0], true
+	}
+	requested = strings.ToLower(requested)
+	for _, extension := range extensions {
+		if extension == requested {
+			return extensions[0], true
+		}
+	}
+	return extensions[0], false
+}
+
+// filterImage copies the given image through the given filter into a new temporary file, which the caller must remove.
+func filterImage(file *os.File, filter func(w io.Writer, r io.ReadSeeker) error) (*os.File, int64, string, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(filter(writer, file))
+	}()
+	filtered, size, hash, err := spoolImage(reader)
+	// Make sure the goroutine exits even if spooling fails.
+	reader.Close()
+	return filtered, size, hash, err
+}
+
+// detectType returns the MIME type of the given file. SVG images are detected separately, as
+// http.DetectContentType considers them text.
+func detectType(file io.ReadSeeker) string {
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(file, header)
+	mimeType := http.DetectContentType(header[:n])
+	if strings.HasPrefix(mimeType, "text/") {
+		file.Seek(0, io.SeekStart)
+		if imaging.IsSVG(file) {
+			return "image/svg+xml"
+		}
+	}
+	return mimeType
+}
+
+// allowedType finds the given MIME type from the allowed types in the config. If the config doesn't have a list of
+// allowed types, all images except SVGs are allowed. SVGs are only allowed if the SVG policy isn't reject.
+func allowedType(mimeType string) (data.AllowedType, bool) {
+	if mimeType == "image/svg+xml" && svgPolicy() == "reject" {
+		return data.AllowedType{}, false
+	} else if len(config.AllowedTypes) == 0 {
+		return data.AllowedType{Type: mimeType}, true
+	}
+	for _, allowed := range config.AllowedTypes {
+		if strings.EqualFold(allowed.Type, mimeType) {
+			return allowed, true
+		}
+	}
+	return data.AllowedType{}, false
+}
+
+// storeBlob adds a reference to the blob with the given hash and writes the blob into the image store if it isn't
+// there yet. If storing the blob fails, the reference is removed. The first return value is true if the blob was
+// written into the store.
+func storeBlob(hash string, size int64, file io.Reader) (created bool, err error) {
+	lock := blobLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+	err = database.AddBlobReference(hash, size)
+	if err != nil {
+		return
+	}
+	_, err = store.Stat(data.BlobName(hash))
+	if os.IsNotExist(err) {
+		created = true
+		err = store.Put(data.BlobName(hash), file)
+	}
+	if err != nil {
+		database.RemoveBlobReference(hash)
+		return false, err
+	}
+	return
+}
@@ -18,15 +18,45 @@
 package handlers
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"maunium.net/go/mauimageserver/data"
 	log "maunium.net/go/maulogger"
+	"mime/multipart"
 	"net/http"
+	"strings"
 	"testing"
 )
 
 var image = "iVBORw0KGgoAAAANSUhEUgAAABUAAAARCAIAAAC95HDXAAAAFklEQVR42mP4ThlgGNU/qn9U/4jVDwBiDAmW9sWkNgAAAABJRU5ErkJggg=="
 
+var svgImage = `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"></svg>`
+
+func rawImage() string {
+	data, _ := base64.StdEncoding.DecodeString(image)
+	return string(data)
+}
+
+func imageHash() string {
+	hash := sha256.Sum256([]byte(rawImage()))
+	return hex.EncodeToString(hash[:])
+}
+
+func multipartImage(fields map[string]string, file string) (string, map[string]string) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for key, value := range fields {
+		writer.WriteField(key, value)
+	}
+	part, _ := writer.CreateFormFile("image", "image.png")
+	part.Write([]byte(file))
+	writer.Close()
+	return buf.String(), map[string]string{"Content-Type": writer.FormDataContentType()}
+}
+
 func TestInsert(t *testing.T) {
 	log.InitWithWriter(nil)
 	log.PrintLevel = 9002
@@ -102,6 +132,7 @@ func TestInsert(t *testing.T) {
 		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
 		auth:     fakeAuth{},
 		database: fakeDatabase{},
+		store:    fakeStore{putError: errors.New("fakeError")},
 	}, {
 		action: "POST", path: "/insert", assert: defaultAssert,
 		request:  "{\"image\": \"totallyBase64\"}",
@@ -142,9 +173,341 @@ func TestInsert(t *testing.T) {
 		config:   &data.Configuration{RequireAuth: true, ImageLocation: "/tmp"},
 		auth:     fakeAuth{},
 		database: fakeDatabase{updateError: errors.New("fakeError"), imageOwner: "fakeUser"},
+	}, {
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  "{\"image\": \"" + image + "\"}",
+		status:   http.StatusInternalServerError,
+		expected: nil,
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{blobError: errors.New("fakeError")},
+	}, {
+		// The image has already been uploaded, so it shouldn't be written to the store again.
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  "{\"image\": \"" + image + "\"}",
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+		store:    fakeStore{files: map[string]string{data.BlobName(imageHash()): rawImage()}, putError: errors.New("fakeError")},
 	}}
 
+	body, headers := multipartImage(map[string]string{"image-name": "fakeImage", "client-name": "fakeClient"}, rawImage())
+	cases = append(cases, test{
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  body,
+		headers:  headers,
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	})
+	body, headers = multipartImage(map[string]string{"username": "fakeUser", "auth-token": "fakeAuthToken"}, rawImage())
+	cases = append(cases, test{
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  body,
+		headers:  headers,
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "invalid-authtoken"},
+		config:   &data.Configuration{RequireAuth: true, ImageLocation: "/tmp"},
+		auth:     fakeAuth{authTokenError: errors.New("fakeError")},
+		database: fakeDatabase{},
+	})
+	body, headers = multipartImage(map[string]string{"image-name": "fakeImage"}, "fakeImage")
+	cases = append(cases, test{
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  body,
+		headers:  headers,
+		status:   http.StatusUnsupportedMediaType,
+		expected: &GenericResponse{Success: false, Status: "invalid-mime"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	})
+	body, headers = multipartImage(map[string]string{"image-name": "fakeImage"}, "")
+	cases = append(cases, test{
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  strings.Replace(body, "name=\"image\"", "name=\"notImage\"", 1),
+		headers:  headers,
+		status:   http.StatusBadRequest,
+		expected: nil,
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-Username": "fakeUser", "X-Auth-Token": "fakeAuthToken", "X-Image-Format": "png"},
+		status:   http.StatusAccepted,
+		expected: &GenericResponse{Success: true, Status: "replaced"},
+		config:   &data.Configuration{RequireAuth: true, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{imageOwner: "fakeUser"},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "not-logged-in"},
+		config:   &data.Configuration{RequireAuth: true, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusRequestEntityTooLarge,
+		expected: &GenericResponse{Success: false, Status: "too-large"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", MaxUploadSize: 16},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  "{\"image\": \"" + image + "\"}",
+		status:   http.StatusRequestEntityTooLarge,
+		expected: &GenericResponse{Success: false, Status: "too-large"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", MaxUploadSize: 16},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  "{\"image\": \"" + image + "\"}",
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", MaxUploadSize: int64(len(rawImage()))},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", StripMetadata: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		// Metadata can't be stripped from a truncated image.
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage()[:len(rawImage())-6],
+		status:   http.StatusUnsupportedMediaType,
+		expected: &GenericResponse{Success: false, Status: "invalid-image"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", StripMetadata: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		// Anonymous users can't disable metadata stripping.
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage()[:len(rawImage())-6],
+		headers:  map[string]string{"X-Keep-Metadata": "true"},
+		status:   http.StatusUnsupportedMediaType,
+		expected: &GenericResponse{Success: false, Status: "invalid-image"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", StripMetadata: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage()[:len(rawImage())-6],
+		headers:  map[string]string{"X-Username": "fakeUser", "X-Auth-Token": "fakeAuthToken", "X-Keep-Metadata": "true"},
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", StripMetadata: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		// The format is normalized to the detected type by default.
+		action: "PUT", path: "/insert/fakeImage.gif", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.gif", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusUnsupportedMediaType,
+		expected: &GenericResponse{Success: false, Status: "format-mismatch"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", FormatMismatch: "reject"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.PNG", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", FormatMismatch: "reject"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusUnsupportedMediaType,
+		expected: &GenericResponse{Success: false, Status: "type-not-allowed"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", AllowedTypes: []data.AllowedType{{Type: "image/jpeg"}}},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusRequestEntityTooLarge,
+		expected: &GenericResponse{Success: false, Status: "too-large"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", AllowedTypes: []data.AllowedType{{Type: "image/png", MaxSize: 10}}},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", AllowedTypes: []data.AllowedType{{Type: "image/PNG", MaxSize: 1000}}},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		// SVG images are rejected by default.
+		action: "PUT", path: "/insert/fakeImage.svg", assert: defaultAssert,
+		request:  svgImage,
+		status:   http.StatusUnsupportedMediaType,
+		expected: &GenericResponse{Success: false, Status: "type-not-allowed"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.svg", assert: defaultAssert,
+		request:  svgImage,
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", SVG: "sanitize"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.svg", assert: defaultAssert,
+		request:  "<svg><g></svg>",
+		status:   http.StatusUnsupportedMediaType,
+		expected: &GenericResponse{Success: false, Status: "invalid-image"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", SVG: "sanitize"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.svg", assert: defaultAssert,
+		request:  svgImage,
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp", SVG: "attachment"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-Visibility": "secret"},
+		status:   http.StatusBadRequest,
+		expected: &GenericResponse{Success: false, Status: "invalid-visibility"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		// Private images need an owner.
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-Visibility": "private"},
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "not-logged-in"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-Visibility": "private", "X-Username": "fakeUser", "X-Auth-Token": "fakeAuthToken"},
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-Expires-At": "1500000000"},
+		status:   http.StatusBadRequest,
+		expected: &GenericResponse{Success: false, Status: "invalid-expiry"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "POST", path: "/insert", assert: defaultAssert,
+		request:  "{\"image\": \"" + image + "\", \"ttl\": 60, \"expires-at\": 4000000000}",
+		status:   http.StatusBadRequest,
+		expected: &GenericResponse{Success: false, Status: "invalid-expiry"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-TTL": "3600", "X-Max-Views": "1"},
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-Password": strings.Repeat("a", 73)},
+		status:   http.StatusBadRequest,
+		expected: &GenericResponse{Success: false, Status: "invalid-password"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert/fakeImage.png", assert: defaultAssert,
+		request:  rawImage(),
+		headers:  map[string]string{"X-Password": "fakePassword"},
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "created"},
+		config:   &data.Configuration{RequireAuth: false, ImageLocation: "/tmp"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, test{
+		action: "PUT", path: "/insert", assert: defaultAssert,
+		request:  rawImage(),
+		status:   http.StatusMethodNotAllowed,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	})
+
 	for index, c := range cases {
 		run(index+1, c, t)
 	}
 }
+
+func TestCanonicalFormat(t *testing.T) {
+	cases := []struct {
+		mimeType, requested, format string
+		ok                          bool
+	}{
+		{"png", "", "png", true},
+		{"png", "png", "png", true},
+		{"png", "gif", "png", false},
+		{"jpeg", "JPG", "jpg", true},
+		{"jpeg", "jpeg", "jpg", true},
+		{"jpeg", "png", "jpg", false},
+		{"x-icon", "ico", "ico", true},
+		{"tiff", "tiff", "tiff", true},
+	}
+	for index, c := range cases {
+		format, ok := canonicalFormat(c.mimeType, c.requested)
+		if format != c.format || ok != c.ok {
+			t.Errorf("[#%d] Expected %s/%t for %s as %s, but received %s/%t", index+1, c.format, c.ok, c.mimeType, c.requested, format, ok)
+		}
+	}
+}
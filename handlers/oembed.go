@@ -0,0 +1,127 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"maunium.net/go/mauimageserver/data"
+	"maunium.net/go/mauimageserver/imaging"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OEmbedResponse is the response for oEmbed requests. See https://oembed.com/ for details.
+type OEmbedResponse struct {
+	Type         string `json:"type"`
+	Version      string `json:"version"`
+	Title        string `json:"title,omitempty"`
+	AuthorName   string `json:"author_name,omitempty"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	URL          string `json:"url"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+// OEmbed handles oEmbed requests (GET /oembed?url={image page address}). Only the JSON format is supported.
+//
+// If maxwidth or maxheight is given and the image is larger, the largest thumbnail that fits is used instead.
+func OEmbed(w http.ResponseWriter, r *http.Request) {
+	var ip = getIP(r)
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	if format := query.Get("format"); len(format) > 0 && format != "json" {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	pageURL, err := url.Parse(query.Get("url"))
+	if err != nil || len(pageURL.Path) < 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	imageName := strings.TrimSuffix(pageURL.Path[1:], "/download")
+	img, err := database.Query(imageName)
+	if err != nil {
+		if dot := strings.IndexByte(imageName, '.'); dot >= 0 {
+			img, err = database.Query(imageName[:dot])
+		}
+	}
+	if err != nil || img.Visibility == data.VisibilityPrivate || img.Protected || img.MaxViews > 0 ||
+		img.Expired(time.Now()) {
+		// Private and password-protected images can't be embedded, as the embedding site wouldn't be able to load
+		// the image. Images with a view limit would use up views whenever the embed is shown, and expired images are
+		// removed soon.
+		log.Debugf("%[1]s requested oEmbed data of %[2]s, which doesn't exist or is private.", ip, imageName)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	maxWidth, _ := strconv.Atoi(query.Get("maxwidth"))
+	maxHeight, _ := strconv.Atoi(query.Get("maxheight"))
+
+	base := publicURL(r)
+	response := OEmbedResponse{
+		Type:         "photo",
+		Version:      "1.0",
+		Title:        img.ImageName,
+		AuthorName:   img.Adder,
+		ProviderName: "mauImageServer",
+		ProviderURL:  base + "/",
+		URL:          base + "/" + url.PathEscape(img.ImageName) + "." + img.Format,
+		Width:        img.Width,
+		Height:       img.Height,
+	}
+	if size, width, height := oEmbedThumbnail(img, maxWidth, maxHeight); size > 0 {
+		response.URL = base + "/thumb/" + url.PathEscape(img.ImageName) + "?size=" + strconv.Itoa(size)
+		response.Width, response.Height = width, height
+	}
+	output(w, response, http.StatusOK)
+}
+
+// oEmbedThumbnail finds the largest thumbnail size of the given image that fits in the given maximum size. Zero is
+// returned if the image itself fits, or if the image doesn't have thumbnails. A zero maximum means no limit.
+func oEmbedThumbnail(img data.ImageEntry, maxWidth, maxHeight int) (size, width, height int) {
+	if maxWidth <= 0 {
+		maxWidth = img.Width
+	}
+	if maxHeight <= 0 {
+		maxHeight = img.Height
+	}
+	if img.Width <= maxWidth && img.Height <= maxHeight || !hasThumbnails(img) {
+		return 0, 0, 0
+	}
+	sizes := thumbnailSizes()
+	for i := len(sizes) - 1; i >= 0; i-- {
+		width, height = imaging.Fit(img.Width, img.Height, sizes[i], sizes[i])
+		if width <= maxWidth && height <= maxHeight {
+			return sizes[i], width, height
+		}
+	}
+	// Nothing fits, so the smallest thumbnail is the best option.
+	if len(sizes) > 0 {
+		width, height = imaging.Fit(img.Width, img.Height, sizes[0], sizes[0])
+		return sizes[0], width, height
+	}
+	return 0, 0, 0
+}
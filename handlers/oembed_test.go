@@ -0,0 +1,107 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"encoding/json"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestOEmbed(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	conf := &data.Configuration{PublicURL: "https://i.example.com/"}
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: fakeHash, Width: 2000, Height: 1000}
+	assertEmbed := func(expected OEmbedResponse) func(int, test, *testing.T, *httptest.ResponseRecorder) {
+		return func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			var received OEmbedResponse
+			err := json.Unmarshal(recorder.Body.Bytes(), &received)
+			if recorder.Code != c.status {
+				t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, c.status, recorder.Code)
+			} else if err != nil {
+				t.Errorf("[%s #%d] Response JSON invalid: %s", c.path, index, err)
+			} else if received != expected {
+				t.Errorf("[%s #%d] Response didn't match!\nExpected %+v\nbut received %+v", c.path, index, expected, received)
+			}
+		}
+	}
+	original := OEmbedResponse{
+		Type: "photo", Version: "1.0", Title: "fakeImage", AuthorName: "fakeUser",
+		ProviderName: "mauImageServer", ProviderURL: "https://i.example.com/",
+		URL: "https://i.example.com/fakeImage.png", Width: 2000, Height: 1000,
+	}
+	thumbnail := original
+	thumbnail.URL, thumbnail.Width, thumbnail.Height = "https://i.example.com/thumb/fakeImage?size=1024", 1024, 512
+	limited := image
+	limited.MaxViews = 1
+	expired := image
+	expired.ExpiresAt = time.Now().Unix() - 10
+	pageURL := url.QueryEscape("https://i.example.com/fakeImage")
+	cases := []test{{
+		action: "GET", path: "/oembed?url=" + pageURL, assert: assertEmbed(original),
+		status:   http.StatusOK,
+		config:   conf,
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		action: "GET", path: "/oembed?format=json&url=" + url.QueryEscape("https://i.example.com/fakeImage.png"), assert: assertEmbed(original),
+		status:   http.StatusOK,
+		config:   conf,
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		action: "GET", path: "/oembed?maxwidth=1200&url=" + pageURL, assert: assertEmbed(thumbnail),
+		status:   http.StatusOK,
+		config:   conf,
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		action: "GET", path: "/oembed?format=xml&url=" + pageURL, assert: defaultAssert,
+		status:   http.StatusNotImplemented,
+		config:   conf,
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		action: "GET", path: "/oembed?url=" + url.QueryEscape("https://i.example.com/otherImage"), assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   conf,
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		// Showing the embed would use up views.
+		action: "GET", path: "/oembed?url=" + pageURL, assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   conf,
+		database: fakeDatabase{queryImage: limited, exactQuery: true},
+	}, {
+		action: "GET", path: "/oembed?url=" + pageURL, assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   conf,
+		database: fakeDatabase{queryImage: expired, exactQuery: true},
+	}, {
+		action: "GET", path: "/oembed", assert: defaultAssert,
+		status:   http.StatusBadRequest,
+		config:   conf,
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
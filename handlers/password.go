@@ -0,0 +1,173 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"golang.org/x/crypto/bcrypt"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unlockDuration is how long a password-protected image stays unlocked after entering the password.
+const unlockDuration = time.Hour
+
+// unlockKey is used to sign unlock cookies if the config doesn't have a link secret. Cookies signed with it don't
+// work after a restart, which is fine as they're short-lived anyway.
+var unlockKey = func() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// hashPassword hashes the given image password with bcrypt.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// unlockCookieName returns the name of the cookie that unlocks the given image. Image names can contain characters
+// that aren't allowed in cookie names, so the name is encoded.
+func unlockCookieName(imageName string) string {
+	return "mis-unlock-" + base64.RawURLEncoding.EncodeToString([]byte(imageName))
+}
+
+// unlockToken calculates the value of the unlock cookie of the given image that is valid until the given time.
+// The password hash is included so that changing the password invalidates old cookies.
+func unlockToken(img data.ImageEntry, expires int64) string {
+	key := unlockKey
+	if len(config.LinkSecret) > 0 {
+		key = []byte(config.LinkSecret)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("unlock\n" + img.ImageName + "\n" + strconv.FormatInt(expires, 10) + "\n" + img.PasswordHash))
+	return strconv.FormatInt(expires, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unlocked checks if the sender of the given request can view the given image without entering its password. That's
+// the case if the image doesn't have a password, if the request has a valid unlock cookie or signed link, or if the
+// request is from the uploader.
+func unlocked(r *http.Request, img data.ImageEntry) bool {
+	if !img.Protected || validSignature(r.URL.Query(), img) {
+		return true
+	} else if cookie, err := r.Cookie(unlockCookieName(img.ImageName)); err == nil {
+		parts := strings.SplitN(cookie.Value, ".", 2)
+		expires, err := strconv.ParseInt(parts[0], 10, 64)
+		if err == nil && time.Now().Unix() < expires && hmac.Equal([]byte(cookie.Value), []byte(unlockToken(img, expires))) {
+			return true
+		}
+	}
+	username, err := requestUser(r)
+	return err == nil && len(username) > 0 && username == img.Adder
+}
+
+// lockedEntry removes the details of the image file from the given password-protected image. The hash identifies
+// the image, so it must not be revealed to users who haven't entered the password.
+func lockedEntry(img data.ImageEntry) data.ImageEntry {
+	img.Hash, img.Width, img.Height, img.Bytes = "", 0, 0, 0
+	return img
+}
+
+// checkPassword makes sure that the given image is unlocked for the sender of the given request. If not, 403 is sent
+// to the given ResponseWriter. Responses with password-protected images depend on cookies, so they're marked private.
+func checkPassword(w http.ResponseWriter, r *http.Request, img data.ImageEntry) bool {
+	if !img.Protected {
+		return true
+	} else if !unlocked(r, img) {
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	return true
+}
+
+// sendLockedPage sends the image page of the given image with the password form instead of the image.
+func sendLockedPage(w http.ResponseWriter, r *http.Request, img data.ImageEntry, unlockError string) {
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.WriteHeader(http.StatusForbidden)
+	data.ImagePage{
+		ImageName:   img.ImageName,
+		Uploader:    img.Adder,
+		Client:      img.Client,
+		Date:        time.Unix(img.Timestamp, 0).Format(config.DateFormat),
+		Index:       strconv.Itoa(img.ID),
+		PageURL:     publicURL(r) + "/" + url.PathEscape(img.ImageName),
+		Locked:      true,
+		UnlockAddr:  "/unlock/" + url.PathEscape(img.ImageName),
+		UnlockError: unlockError,
+	}.Send(w)
+}
+
+// Unlock handles password submissions for password-protected images (POST /unlock/{name}). If the password is
+// correct, a cookie that unlocks the image for a short while is set and the client is redirected to the image page.
+func Unlock(w http.ResponseWriter, r *http.Request) {
+	var ip = getIP(r)
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	imageName := strings.TrimPrefix(r.URL.Path, "/unlock/")
+	img, err := database.Query(imageName)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if !checkView(w, r, img) || !checkExpiry(w, img) {
+		return
+	}
+	pageAddr := "/" + url.PathEscape(img.ImageName)
+	if !img.Protected {
+		http.Redirect(w, r, pageAddr, http.StatusSeeOther)
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(img.PasswordHash), []byte(r.PostFormValue("password")))
+	if err != nil {
+		log.Debugf("%[1]s entered the wrong password for %[2]s.", ip, img.ImageName)
+		sendLockedPage(w, r, img, "The password was incorrect.")
+		return
+	}
+	expires := time.Now().Add(unlockDuration)
+	// The cookie is only sent with requests for this image. A cookie path only matches subpaths, so the page (which
+	// also covers /download), the image itself and the thumbnails each need their own cookie.
+	for _, path := range []string{pageAddr, pageAddr + "." + img.Format, "/thumb" + pageAddr} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     unlockCookieName(img.ImageName),
+			Value:    unlockToken(img, expires.Unix()),
+			Path:     path,
+			Expires:  expires,
+			Secure:   strings.HasPrefix(publicURL(r), "https://"),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	log.Debugf("%[1]s unlocked %[2]s.", ip, img.ImageName)
+	http.Redirect(w, r, pageAddr, http.StatusSeeOther)
+}
@@ -0,0 +1,176 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func protectedImage(t *testing.T) data.ImageEntry {
+	hash, err := bcrypt.GenerateFromPassword([]byte("fakePassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %s", err)
+	}
+	return data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: fakeHash,
+		PasswordHash: string(hash), Protected: true}
+}
+
+func TestGetPassword(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	err := data.LoadTemplates("../image.html")
+	if err != nil {
+		t.Fatalf("Failed to load template: %s", err)
+	}
+	image := protectedImage(t)
+	config = &data.Configuration{}
+	cookie := unlockCookieName(image.ImageName) + "=" + unlockToken(image, time.Now().Add(time.Minute).Unix())
+	expiredCookie := unlockCookieName(image.ImageName) + "=" + unlockToken(image, time.Now().Add(-time.Minute).Unix())
+	files := fakeStore{files: map[string]string{image.FileName(): "fakeImageData"}}
+	assertLocked := func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+		if recorder.Code != http.StatusForbidden {
+			t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, http.StatusForbidden, recorder.Code)
+		} else if !strings.Contains(recorder.Body.String(), `action="/unlock/fakeImage"`) {
+			t.Errorf("[%s #%d] Page doesn't contain the unlock form", c.path, index)
+		} else if strings.Contains(recorder.Body.String(), "fakeImage.png") {
+			t.Errorf("[%s #%d] Locked page contains the image address", c.path, index)
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/fakeImage", assert: assertLocked,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: defaultAssert,
+		status:   http.StatusForbidden,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/thumb/fakeImage", assert: defaultAssert,
+		status:   http.StatusForbidden,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: assertFile("image/png", "fakeImageData"),
+		headers:  map[string]string{"Cookie": cookie},
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: defaultAssert,
+		headers:  map[string]string{"Cookie": expiredCookie},
+		status:   http.StatusForbidden,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		// The uploader doesn't need the password.
+		action: "GET", path: "/fakeImage.png", assert: assertFile("image/png", "fakeImageData"),
+		headers:  map[string]string{"X-Username": "fakeUser", "X-Auth-Token": "fakeAuthToken"},
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	err := data.LoadTemplates("../image.html")
+	if err != nil {
+		t.Fatalf("Failed to load template: %s", err)
+	}
+	image := protectedImage(t)
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	assertUnlocked := func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+		if recorder.Code != http.StatusSeeOther {
+			t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, http.StatusSeeOther, recorder.Code)
+			return
+		} else if location := recorder.Header().Get("Location"); location != "/fakeImage" {
+			t.Errorf("[%s #%d] Location didn't match! Expected /fakeImage, but received %s", c.path, index, location)
+		}
+		cookies := recorder.Result().Cookies()
+		paths := []string{"/fakeImage", "/fakeImage.png", "/thumb/fakeImage"}
+		if len(cookies) != len(paths) {
+			t.Errorf("[%s #%d] Unexpected cookies %v", c.path, index, cookies)
+			return
+		}
+		for i, cookie := range cookies {
+			if cookie.Name != unlockCookieName(image.ImageName) || cookie.Path != paths[i] || !cookie.HttpOnly {
+				t.Errorf("[%s #%d] Unexpected cookie %v", c.path, index, cookie)
+			}
+		}
+		req := httptest.NewRequest("GET", "/fakeImage.png", nil)
+		req.AddCookie(cookies[0])
+		if !unlocked(req, image) {
+			t.Errorf("[%s #%d] Cookie didn't unlock the image", c.path, index)
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/unlock/fakeImage", assert: defaultAssert,
+		status:   http.StatusMethodNotAllowed,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		action: "POST", path: "/unlock/otherImage", assert: defaultAssert,
+		request:  "password=fakePassword",
+		headers:  form,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		action: "POST", path: "/unlock/fakeImage", assert: defaultAssert,
+		request:  "password=wrongPassword",
+		headers:  form,
+		status:   http.StatusForbidden,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}, {
+		action: "POST", path: "/unlock/fakeImage", assert: assertUnlocked,
+		request:  "password=fakePassword",
+		headers:  form,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
@@ -0,0 +1,209 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"maunium.net/go/mauimageserver/data"
+	"maunium.net/go/mauimageserver/imaging"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// resizeParams are the query parameters of a request for a resized or converted image.
+type resizeParams struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+// String returns the file name of the cached image with these parameters.
+func (params resizeParams) String() string {
+	return fmt.Sprintf("%[1]dx%[2]d-%[3]s-q%[4]d.%[5]s", params.Width, params.Height, params.Fit, params.Quality, params.Format)
+}
+
+// resizeKeys are the query parameters used for resizing.
+var resizeKeys = []string{"w", "h", "fit", "fmt", "q"}
+
+// isResizeRequest checks if the given query contains any resize parameters.
+func isResizeRequest(query url.Values) bool {
+	for _, key := range resizeKeys {
+		if _, ok := query[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseResizeParams reads and validates the resize parameters in the given query. Only the sizes in the config are
+// allowed, as every combination of parameters is cached separately. Converting without resizing is always allowed.
+func parseResizeParams(query url.Values, sourceFormat string) (params resizeParams, err error) {
+	if len(query.Get("w")) > 0 {
+		params.Width, err = strconv.Atoi(query.Get("w"))
+		if err != nil || params.Width < 0 {
+			return params, fmt.Errorf("invalid width")
+		}
+	}
+	if len(query.Get("h")) > 0 {
+		params.Height, err = strconv.Atoi(query.Get("h"))
+		if err != nil || params.Height < 0 {
+			return params, fmt.Errorf("invalid height")
+		}
+	}
+	if !sizeAllowed(params.Width, params.Height) {
+		return params, fmt.Errorf("size %dx%d not allowed", params.Width, params.Height)
+	}
+
+	params.Fit = query.Get("fit")
+	switch params.Fit {
+	case "":
+		params.Fit = imaging.FitContain
+	case imaging.FitContain, imaging.FitCover, imaging.FitFill:
+	default:
+		return params, fmt.Errorf("invalid fit mode %s", params.Fit)
+	}
+
+	params.Format = query.Get("fmt")
+	if len(params.Format) == 0 {
+		params.Format = sourceFormat
+	}
+	switch params.Format {
+	case "jpg":
+		params.Format = "jpeg"
+	case "jpeg", "png", "gif":
+	default:
+		if len(query.Get("fmt")) > 0 {
+			return params, fmt.Errorf("unsupported format %s", params.Format)
+		}
+		// The source format can't be encoded, so fall back to PNG.
+		params.Format = "png"
+	}
+
+	if params.Format == "jpeg" && len(query.Get("q")) > 0 {
+		params.Quality, err = strconv.Atoi(query.Get("q"))
+		if err != nil || params.Quality < 1 || params.Quality > 100 {
+			return params, fmt.Errorf("invalid quality")
+		}
+		// Round the quality to the nearest multiple of ten to limit the number of cached images.
+		params.Quality = (params.Quality + 5) / 10 * 10
+	}
+	return params, nil
+}
+
+func sizeAllowed(width, height int) bool {
+	if width == 0 && height == 0 {
+		return true
+	}
+	size := strconv.Itoa(width) + "x" + strconv.Itoa(height)
+	for _, allowed := range config.Resize.Sizes {
+		if allowed == size {
+			return true
+		}
+	}
+	return false
+}
+
+func resizeCacheLocation() string {
+	if len(config.Resize.CacheLocation) > 0 {
+		return config.Resize.CacheLocation
+	}
+	return filepath.Join(os.TempDir(), "mis-cache")
+}
+
+// resizeCacheDir returns the directory containing the cached resized versions of the given image.
+// Deduplicated images share the directory, as the result only depends on the content.
+func resizeCacheDir(img data.ImageEntry) string {
+	key := img.Hash
+	if len(key) == 0 {
+		hash := sha256.Sum256([]byte(img.FileName()))
+		key = hex.EncodeToString(hash[:])
+	}
+	return filepath.Join(resizeCacheLocation(), key[:2], key)
+}
+
+// removeResized removes all the cached resized versions of the given image.
+func removeResized(img data.ImageEntry) {
+	err := os.RemoveAll(resizeCacheDir(img))
+	if err != nil {
+		log.Warnf("Failed to remove resized versions of %[1]s: %[2]s", img.ImageName, err)
+	}
+}
+
+// serveResized sends a resized version of the given image, creating it if it isn't in the cache yet.
+func serveResized(w http.ResponseWriter, r *http.Request, img data.ImageEntry, file data.ImageFile, params resizeParams) {
+	ip := getIP(r)
+	path := filepath.Join(resizeCacheDir(img), params.String())
+	cached, err := os.Open(path)
+	if os.IsNotExist(err) {
+		src, _, decodeErr := imaging.Decode(file)
+		if decodeErr != nil {
+			log.Debugf("%[1]s requested a resized version of %[2]s, which can't be decoded: %[3]s", ip, img.ImageName, decodeErr)
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		err = writeAtomic(path, func(w io.Writer) error {
+			return imaging.Encode(w, imaging.Transform(src, params.Width, params.Height, params.Fit), params.Format, params.Quality)
+		})
+		if err == nil {
+			cached, err = os.Open(path)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to resize %[2]s for %[1]s: %[3]s", ip, img.ImageName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer cached.Close()
+
+	serveImage(w, r, cached, "image/"+params.Format, imageETag(img, params.String()), imageModified(img))
+}
+
+// writeAtomic creates a file at the given path with the data written by the given function. The data is written into
+// a temporary file first, so that concurrent requests never see a partially written file.
+func writeAtomic(path string, write func(w io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), ".resize-")
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestParseResizeParams(t *testing.T) {
+	config = &data.Configuration{Resize: data.ResizeConfig{Sizes: []string{"400x300", "800x0"}}}
+	cases := []struct {
+		query    string
+		expected resizeParams
+		valid    bool
+	}{
+		{"w=400&h=300", resizeParams{400, 300, "contain", "png", 0}, true},
+		{"w=800&fit=cover&fmt=jpg&q=77", resizeParams{800, 0, "cover", "jpeg", 80}, true},
+		{"fmt=gif&q=50", resizeParams{0, 0, "contain", "gif", 0}, true},
+		{"w=401&h=300", resizeParams{}, false},
+		{"w=-400&h=300", resizeParams{}, false},
+		{"w=400&h=300&fit=stretch", resizeParams{}, false},
+		{"fmt=webp", resizeParams{}, false},
+		{"fmt=jpeg&q=101", resizeParams{}, false},
+	}
+	for index, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		params, err := parseResizeParams(query, "png")
+		if c.valid && err != nil {
+			t.Errorf("[#%d] Valid parameters returned an error: %s", index+1, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("[#%d] Invalid parameters didn't return an error", index+1)
+		} else if c.valid && params != c.expected {
+			t.Errorf("[#%d] Parameters didn't match! Expected %+v, but received %+v", index+1, c.expected, params)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	cache, err := ioutil.TempDir("", "mis-test-")
+	if err != nil {
+		t.Fatalf("Failed to create cache directory: %s", err)
+	}
+	defer os.RemoveAll(cache)
+
+	conf := &data.Configuration{Resize: data.ResizeConfig{Sizes: []string{"10x0"}, CacheLocation: cache}}
+	entry := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: imageHash()}
+	files := fakeStore{files: map[string]string{entry.FileName(): rawImage()}}
+	assertSize := func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+		if recorder.Code != c.status {
+			t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, c.status, recorder.Code)
+			return
+		}
+		img, err := png.Decode(bytes.NewReader(recorder.Body.Bytes()))
+		if err != nil {
+			t.Errorf("[%s #%d] Response is not a PNG image: %s", c.path, index, err)
+		} else if img.Bounds().Dx() != 10 {
+			t.Errorf("[%s #%d] Image width didn't match! Expected 10, but received %d", c.path, index, img.Bounds().Dx())
+		}
+	}
+	cases := []test{{
+		action: "GET", path: "/fakeImage.png?w=10", assert: assertSize,
+		status:   http.StatusOK,
+		config:   conf,
+		database: fakeDatabase{queryImage: entry, exactQuery: true},
+		store:    files,
+	}, {
+		// The second request is served from the cache, so the original isn't needed.
+		action: "GET", path: "/fakeImage.png?w=10", assert: assertSize,
+		status:   http.StatusOK,
+		config:   conf,
+		database: fakeDatabase{queryImage: entry, exactQuery: true},
+		store:    fakeStore{files: map[string]string{entry.FileName(): "notAnImage"}},
+	}, {
+		action: "GET", path: "/fakeImage.png?w=20", assert: defaultAssert,
+		status:   http.StatusBadRequest,
+		config:   conf,
+		database: fakeDatabase{queryImage: entry, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png?fmt=jpeg", assert: defaultAssert,
+		status:   http.StatusUnsupportedMediaType,
+		config:   conf,
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Hash: fakeHash}, exactQuery: true},
+		store:    fakeStore{files: map[string]string{data.BlobName(fakeHash): "notAnImage"}},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
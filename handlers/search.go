@@ -38,10 +38,26 @@ type SearchForm struct {
 
 // SearchResponse is the struct wrapping results for a search query.
 type SearchResponse struct {
-	Success        bool              `json:"success"`
-	Status         string            `json:"status-simple"`
-	StatusReadable string            `json:"status-humanreadable"`
-	Results        []data.ImageEntry `json:"results,omitempty"`
+	Success        bool           `json:"success"`
+	Status         string         `json:"status-simple"`
+	StatusReadable string         `json:"status-humanreadable"`
+	Results        []SearchResult `json:"results,omitempty"`
+}
+
+// SearchResult is a single image in a SearchResponse.
+type SearchResult struct {
+	data.ImageEntry
+	ThumbnailURL string `json:"thumbnail-url,omitempty"`
+}
+
+// searchResult creates the SearchResult of the given image. Images with a view limit don't have a thumbnail URL, as
+// loading the thumbnail would use up a view.
+func searchResult(img data.ImageEntry) SearchResult {
+	result := SearchResult{ImageEntry: img}
+	if img.MaxViews == 0 {
+		result.ThumbnailURL = thumbnailURL(img.ImageName, false)
+	}
+	return result
 }
 
 // String turns a SearchForm into a string
@@ -107,10 +123,21 @@ func Search(w http.ResponseWriter, r *http.Request) {
 	} else {
 		log.Debugf("%[1]s executed a search: %[2]s", ip, sf.String())
 	}
-	output(w, SearchResponse{
+	response := SearchResponse{
 		Success:        true,
 		Status:         "success",
 		StatusReadable: fmt.Sprintf("Search completed with %d results", len(results)),
-		Results:        results,
-	}, http.StatusOK)
+	}
+	now := time.Now()
+	for _, result := range results {
+		if result.Expired(now) {
+			// Expired images are removed soon, and can't be viewed anymore.
+			continue
+		} else if result.Protected && (!authenticated || result.Adder != sf.Adder) {
+			response.Results = append(response.Results, SearchResult{ImageEntry: lockedEntry(result)})
+			continue
+		}
+		response.Results = append(response.Results, searchResult(result))
+	}
+	output(w, response, http.StatusOK)
 }
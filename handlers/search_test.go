@@ -24,12 +24,16 @@ import (
 	log "maunium.net/go/maulogger"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSearch(t *testing.T) {
 	log.InitWithWriter(nil)
 	log.PrintLevel = 9002
+	expiring := []data.ImageEntry{{ImageName: "asd", MaxViews: 2, Views: 1},
+		{ImageName: "dsa", ExpiresAt: time.Now().Unix() - 10}, {ImageName: "sad", MaxViews: 1, Views: 1}}
 	cases := []test{{
 		action: "GET", path: "/search", assert: defaultAssert,
 		request:  "",
@@ -74,7 +78,10 @@ func TestSearch(t *testing.T) {
 			var expected = SearchResponse{
 				Success: true,
 				Status:  "success",
-				Results: []data.ImageEntry{{ImageName: "asd"}, {ImageName: "dsa"}},
+				Results: []SearchResult{
+					{ImageEntry: data.ImageEntry{ImageName: "asd"}, ThumbnailURL: "/thumb/asd?size=256"},
+					{ImageEntry: data.ImageEntry{ImageName: "dsa"}, ThumbnailURL: "/thumb/dsa?size=256"},
+				},
 			}
 
 			var received SearchResponse
@@ -93,10 +100,41 @@ func TestSearch(t *testing.T) {
 				for i := 0; i < len(received.Results); i++ {
 					if received.Results[i].ImageName != expected.Results[i].ImageName {
 						t.Errorf("[%s #%d] Image name of result #%d didn't match! Expected %s, but received %s", c.path, index, i, expected.Results[i].ImageName, received.Results[i].ImageName)
+					} else if received.Results[i].ThumbnailURL != expected.Results[i].ThumbnailURL {
+						t.Errorf("[%s #%d] Thumbnail URL of result #%d didn't match! Expected %s, but received %s", c.path, index, i, expected.Results[i].ThumbnailURL, received.Results[i].ThumbnailURL)
 					}
 				}
 			}
 		},
+	}, {
+		// Expired images are left out, and images with a view limit don't have thumbnails.
+		action: "POST", path: "/search",
+		request:  "{\"adder\": \"fakeUser\"}",
+		status:   http.StatusOK,
+		config:   &data.Configuration{AllowSearch: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{searchImages: expiring},
+		assert: func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			var received SearchResponse
+			json.Unmarshal(recorder.Body.Bytes(), &received)
+			if recorder.Code != c.status || len(received.Results) != 1 || received.Results[0].ImageName != "asd" ||
+				len(received.Results[0].ThumbnailURL) > 0 {
+				t.Errorf("[%s #%d] Results didn't match! Received %s", c.path, index, recorder.Body.String())
+			}
+		},
+	}, {
+		// The hash of a password-protected image would lead to the image without the password.
+		action: "POST", path: "/search",
+		request:  "{\"adder\": \"fakeUser\"}",
+		status:   http.StatusOK,
+		config:   &data.Configuration{AllowSearch: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{searchImages: []data.ImageEntry{{ImageName: "asd", Adder: "fakeUser", Hash: fakeHash, Protected: true}}},
+		assert: func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			if recorder.Code != c.status || strings.Contains(recorder.Body.String(), fakeHash) {
+				t.Errorf("[%s #%d] Response contains the hash of a locked image: %s", c.path, index, recorder.Body.String())
+			}
+		},
 	}}
 
 	for index, c := range cases {
@@ -18,12 +18,16 @@
 package handlers
 
 import (
+	"crypto/rand"
 	"encoding/json"
-	"math/rand"
+	"io"
 	"maunium.net/go/mauimageserver/data"
 	"maunium.net/go/mauth"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,16 +37,19 @@ type GenericResponse struct {
 	Status         string `json:"status-simple"`
 	StatusReadable string `json:"status-humanreadable"`
 	ImageName      string `json:"image-name,omitempty"`
+	UploadID       string `json:"upload-id,omitempty"`
 }
 
 var auth mauth.System
 var database data.MISDatabase
+var store data.ImageStore
 var config *data.Configuration
 
 // Init initializes the handler package
-func Init(_config *data.Configuration, _database data.MISDatabase, _auth mauth.System) {
+func Init(_config *data.Configuration, _database data.MISDatabase, _store data.ImageStore, _auth mauth.System) {
 	config = _config
 	database = _database
+	store = _store
 	auth = _auth
 }
 
@@ -53,6 +60,142 @@ func getIP(r *http.Request) string {
 	return strings.Split(r.RemoteAddr, ":")[0]
 }
 
+// publicURL returns the address of this server without a trailing slash, e.g. https://i.example.com. If the public
+// URL isn't configured, it's guessed from the request.
+func publicURL(r *http.Request) string {
+	if len(config.PublicURL) > 0 {
+		return strings.TrimSuffix(config.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || (config.TrustHeaders && r.Header.Get("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// blobLocks make changing the reference count of a blob and writing or deleting the blob in the image store atomic.
+// Otherwise an upload could add a reference to a blob that is being deleted, and end up pointing to a missing file.
+// The lock of a blob is chosen by the first byte of its hash.
+var blobLocks [256]sync.Mutex
+
+func blobLock(hash string) *sync.Mutex {
+	index, _ := strconv.ParseUint(hash[:2], 16, 8)
+	return &blobLocks[index]
+}
+
+// removeImageFile releases the file of the given image. Deduplicated blobs are only removed from the image store
+// when no other image uses them.
+func removeImageFile(image data.ImageEntry) error {
+	if len(image.Hash) > 0 {
+		lock := blobLock(image.Hash)
+		lock.Lock()
+		defer lock.Unlock()
+		refs, err := database.RemoveBlobReference(image.Hash)
+		if err != nil || refs > 0 {
+			return err
+		}
+		removeThumbnails(image)
+	}
+	removeResized(image)
+	return store.Delete(image.FileName())
+}
+
+// removeImage removes the given image from the database and the image store. A missing file is not an error.
+func removeImage(image data.ImageEntry) error {
+	err := database.Remove(image.ImageName)
+	if err != nil {
+		return err
+	}
+	err = removeImageFile(image)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// svgPolicy returns the configured way to handle SVG images: reject (the default), sanitize or attachment.
+func svgPolicy() string {
+	switch policy := strings.ToLower(config.SVG); policy {
+	case "sanitize", "attachment":
+		return policy
+	default:
+		return "reject"
+	}
+}
+
+// setContentType sets the Content-Type header of an image response. SVG images can contain scripts that would run
+// on this domain, so they're always sandboxed, and sent as downloads if the SVG policy is attachment.
+func setContentType(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-type", contentType)
+	if contentType == "image/svg+xml" {
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		if svgPolicy() == "attachment" && len(w.Header().Get("Content-Disposition")) == 0 {
+			w.Header().Set("Content-Disposition", "attachment")
+		}
+	}
+}
+
+// defaultCacheControl is the Cache-Control header used for images if the config doesn't have one. Images can be
+// replaced, so clients should check for changes every now and then, which is cheap thanks to ETags.
+const defaultCacheControl = "public, max-age=3600"
+
+// serveImage sends the given image file with caching headers. A Cache-Control header that is already set is kept.
+// http.ServeContent takes care of conditional and range requests. The ETag should be the content hash in quotes, or
+// empty if the hash isn't known. A zero modification time means the Last-Modified header isn't sent.
+func serveImage(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, contentType, etag string, modified time.Time) {
+	cacheControl := config.CacheControl
+	if len(cacheControl) == 0 {
+		cacheControl = defaultCacheControl
+	}
+	if len(w.Header().Get("Cache-Control")) == 0 {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if len(etag) > 0 {
+		w.Header().Set("ETag", etag)
+	}
+	if len(contentType) > 0 {
+		setContentType(w, contentType)
+	}
+	http.ServeContent(w, r, "", modified, file)
+}
+
+// notModified checks if http.ServeContent would respond to the given request with 304 Not Modified, i.e. if the
+// client already has the file with the given ETag and modification time.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	} else if ifNoneMatch := r.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || (len(etag) > 0 && tag == strings.TrimPrefix(etag, "W/")) {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(since)
+}
+
+// imageETag returns the strong ETag of the given image with the given suffix, or an empty string if the image
+// doesn't have a hash. The suffix identifies the variant (e.g. a thumbnail size) when the image isn't the original.
+func imageETag(image data.ImageEntry, suffix string) string {
+	if len(image.Hash) == 0 {
+		return ""
+	} else if len(suffix) > 0 {
+		return `"` + image.Hash + "-" + suffix + `"`
+	}
+	return `"` + image.Hash + `"`
+}
+
+// imageModified returns the time the given image was uploaded, or the zero time if it's not known.
+func imageModified(image data.ImageEntry) time.Time {
+	if image.Timestamp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(image.Timestamp, 0)
+}
+
 func output(w http.ResponseWriter, response interface{}, status int) bool {
 	// Marshal the response
 	json, err := json.Marshal(response)
@@ -68,28 +211,26 @@ func output(w http.ResponseWriter, response interface{}, status int) bool {
 }
 
 const imageNameAC = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ123456789"
-const (
-	letterIdxBits = 6
-	letterIdxMask = 1<<letterIdxBits - 1
-	letterIdxMax  = 63 / letterIdxBits
-)
 
-var src = rand.NewSource(time.Now().UnixNano())
+// imageNameMask is the smallest bit mask that covers all indexes of imageNameAC.
+const imageNameMask = 1<<6 - 1
 
-// ImageName generates a string matching [a-zA-Z0-9]{length}
+// ImageName generates a random string matching [a-zA-Z1-9]{length}. The names are generated with crypto/rand, as
+// knowing the name is enough to view an unlisted image.
 func ImageName(length int) string {
-	b := make([]byte, length)
-	for i, cache, remain := 4, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+	b := make([]byte, 0, length)
+	random := make([]byte, length+length/4+1)
+	for len(b) < length {
+		// Reading from crypto/rand only fails if the operating system's random source is broken.
+		if _, err := rand.Read(random); err != nil {
+			panic(err)
 		}
-		if idx := int(cache & letterIdxMask); idx < len(imageNameAC) {
-			b[i] = imageNameAC[idx]
-			i--
+		for _, r := range random {
+			// Random bytes outside the alphabet are skipped, as wrapping them around would make some letters more common.
+			if idx := int(r & imageNameMask); idx < len(imageNameAC) && len(b) < length {
+				b = append(b, imageNameAC[idx])
+			}
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
-
 	return string(b)
 }
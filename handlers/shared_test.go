@@ -20,45 +20,76 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
 	"maunium.net/go/mauimageserver/data"
 	"maunium.net/go/mauth"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 type test struct {
 	action   string
 	path     string
 	request  string
+	headers  map[string]string
 	status   int
 	expected *GenericResponse
 	database data.MISDatabase
+	store    data.ImageStore
 	auth     mauth.System
 	config   *data.Configuration
 	assert   func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder)
 }
 
 func run(index int, c test, t *testing.T) {
-	Init(c.config, c.database, c.auth)
+	if c.store == nil {
+		c.store = fakeStore{}
+	}
+	Init(c.config, c.database, c.store, c.auth)
 
 	req, err := http.NewRequest(c.action, c.path, strings.NewReader(c.request))
 	if err != nil {
 		t.Fatalf("Request error: %s", err)
 	}
 	req.RemoteAddr = "fakeIP"
+	for key, value := range c.headers {
+		req.Header.Set(key, value)
+	}
 
 	var recorder = httptest.NewRecorder()
 
-	if c.path == "/insert" {
+	if strings.HasPrefix(c.path, "/insert") {
 		Insert(recorder, req)
 	} else if c.path == "/delete" {
 		Delete(recorder, req)
+	} else if c.path == "/trash" {
+		Trash(recorder, req)
+	} else if c.path == "/restore" {
+		Restore(recorder, req)
 	} else if c.path == "/hide" {
 		Hide(recorder, req)
+	} else if strings.HasPrefix(c.path, "/unlock/") {
+		Unlock(recorder, req)
+	} else if c.path == "/sign" {
+		Sign(recorder, req)
 	} else if c.path == "/search" {
 		Search(recorder, req)
+	} else if strings.HasPrefix(c.path, "/upload") {
+		Upload(recorder, req)
+	} else if strings.HasPrefix(c.path, "/oembed") {
+		OEmbed(recorder, req)
+	} else if strings.HasPrefix(c.path, "/api/images/") {
+		ImageInfo(recorder, req)
+	} else if strings.HasPrefix(c.path, "/thumb") {
+		Thumbnail(recorder, req)
+	} else {
+		Get(recorder, req)
 	}
 
 	c.assert(index, c, t, recorder)
@@ -80,7 +111,7 @@ func defaultAssert(index int, c test, t *testing.T, recorder *httptest.ResponseR
 	} else if recorder.Code != c.status {
 		t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, c.status, recorder.Code)
 	} else if received.Success != c.expected.Success {
-		t.Errorf("[%s #%d] Success value didn't match! Expected %b, but received %b", c.path, index, c.expected.Success, received.Success)
+		t.Errorf("[%s #%d] Success value didn't match! Expected %t, but received %t", c.path, index, c.expected.Success, received.Success)
 	} else if received.Status != c.expected.Status {
 		t.Errorf("[%s #%d] Status message didn't match! Expected %s, but received %s", c.path, index, c.expected.Status, received.Status)
 	}
@@ -115,9 +146,13 @@ func (fake fakeAuth) CheckAuthToken(username string, authtoken []byte) error {
 	return fake.authTokenError
 }
 
+const fakeHash = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
 type fakeDatabase struct {
 	queryImage data.ImageEntry
 	queryError error
+	// If exactQuery is true, querying any name other than the name of queryImage fails.
+	exactQuery bool
 	imageOwner string
 
 	searchImages []data.ImageEntry
@@ -127,25 +162,45 @@ type fakeDatabase struct {
 	hideError   error
 	insertError error
 	updateError error
+	viewError   error
+	trashError  error
+
+	// deletedImage is returned by QueryDeleted. An empty name means that the trash is empty.
+	deletedImage data.ImageEntry
+
+	blobRefs  int
+	blobError error
 }
 
 func (fake fakeDatabase) Load() error            { return nil }
 func (fake fakeDatabase) Unload() error          { return nil }
 func (fake fakeDatabase) GetInternalDB() *sql.DB { return nil }
 
-func (fake fakeDatabase) Insert(imageName, imageFormat, mimeType, adder, adderip, client string, hidden bool) error {
+func (fake fakeDatabase) Insert(image data.ImageEntry) error {
 	return fake.insertError
 }
-func (fake fakeDatabase) Update(imageName, imageFormat, mimeType, adderip, client string, hidden bool) error {
+func (fake fakeDatabase) Update(image data.ImageEntry) error {
 	return fake.updateError
 }
 func (fake fakeDatabase) Remove(imageName string) error {
 	return fake.removeError
 }
-func (fake fakeDatabase) SetHidden(imageName string, hidden bool) error {
+func (fake fakeDatabase) SetVisibility(imageName, visibility string) error {
 	return fake.hideError
 }
+func (fake fakeDatabase) Trash(imageName string) error {
+	return fake.trashError
+}
+func (fake fakeDatabase) Restore(imageName string) error {
+	return fake.trashError
+}
+func (fake fakeDatabase) AddView(imageName string) (bool, error) {
+	return !fake.queryImage.Expired(time.Now()), fake.viewError
+}
 func (fake fakeDatabase) Query(imageName string) (data.ImageEntry, error) {
+	if fake.exactQuery && imageName != fake.queryImage.ImageName {
+		return data.ImageEntry{}, errors.New("No data found")
+	}
 	return fake.queryImage, fake.queryError
 }
 func (fake fakeDatabase) GetOwner(imageName string) string {
@@ -154,3 +209,66 @@ func (fake fakeDatabase) GetOwner(imageName string) string {
 func (fake fakeDatabase) Search(format, adder, client string, timeMin, timeMax int64, showHidden bool) ([]data.ImageEntry, error) {
 	return fake.searchImages, fake.searchError
 }
+func (fake fakeDatabase) QueryDeleted(imageName string) (data.ImageEntry, error) {
+	if len(fake.deletedImage.ImageName) == 0 {
+		return data.ImageEntry{}, errors.New("No data found")
+	}
+	return fake.deletedImage, nil
+}
+func (fake fakeDatabase) QueryTrash(adder string, deletedBefore int64) ([]data.ImageEntry, error) {
+	return fake.searchImages, fake.searchError
+}
+func (fake fakeDatabase) QueryExpired(now int64) ([]data.ImageEntry, error) {
+	return fake.searchImages, fake.searchError
+}
+func (fake fakeDatabase) AddBlobReference(hash string, size int64) error {
+	return fake.blobError
+}
+func (fake fakeDatabase) RemoveBlobReference(hash string) (int, error) {
+	return fake.blobRefs, fake.blobError
+}
+
+type fakeStore struct {
+	files map[string]string
+
+	putError    error
+	deleteError error
+}
+
+type fakeFile struct {
+	*strings.Reader
+}
+
+func (fake fakeFile) Close() error { return nil }
+
+func (fake fakeStore) Put(name string, data io.Reader) error {
+	if fake.putError != nil {
+		return fake.putError
+	}
+	_, err := io.Copy(ioutil.Discard, data)
+	return err
+}
+func (fake fakeStore) Open(name string) (data.ImageFile, error) {
+	file, ok := fake.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return fakeFile{strings.NewReader(file)}, nil
+}
+func (fake fakeStore) Stat(name string) (data.FileInfo, error) {
+	file, ok := fake.files[name]
+	if !ok {
+		return data.FileInfo{}, os.ErrNotExist
+	}
+	return data.FileInfo{Name: name, Size: int64(len(file))}, nil
+}
+func (fake fakeStore) Delete(name string) error {
+	return fake.deleteError
+}
+func (fake fakeStore) List() ([]string, error) {
+	var names []string
+	for name := range fake.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
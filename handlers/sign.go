@@ -0,0 +1,215 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultLinkExpiry is the time signed links are valid for if the sign request doesn't specify it.
+const defaultLinkExpiry = 24 * time.Hour
+
+// maxLinkExpiry is the longest time signed links can be valid for.
+const maxLinkExpiry = 365 * 24 * time.Hour
+
+// SignForm is the form for creating signed links. AuthToken is required.
+type SignForm struct {
+	ImageName string `json:"image-name"`
+	Username  string `json:"username"`
+	AuthToken string `json:"auth-token"`
+	// ExpiresIn is the number of seconds the link is valid for. Defaults to one day and can be at most a year.
+	ExpiresIn int64 `json:"expires-in"`
+	// Params are resize parameters (w, h, fit, fmt and q). If set, the link only works with exactly these parameters.
+	Params map[string]string `json:"params"`
+}
+
+// SignResponse is the response for sign requests.
+type SignResponse struct {
+	Success        bool   `json:"success"`
+	Status         string `json:"status-simple"`
+	StatusReadable string `json:"status-humanreadable"`
+	URL            string `json:"url,omitempty"`
+	PageURL        string `json:"page-url,omitempty"`
+	Expires        int64  `json:"expires,omitempty"`
+}
+
+// Sign handles requests for signed links (POST /sign). Only the uploader of an image can create signed links to it.
+func Sign(w http.ResponseWriter, r *http.Request) {
+	var ip = getIP(r)
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var sfr SignForm
+	err := decoder.Decode(&sfr)
+	if err != nil || len(sfr.ImageName) == 0 || len(sfr.Username) == 0 || len(sfr.AuthToken) == 0 ||
+		sfr.ExpiresIn < 0 || sfr.ExpiresIn > int64(maxLinkExpiry/time.Second) {
+		log.Debugf("%[1]s sent an invalid sign request.", ip)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if len(config.LinkSecret) == 0 {
+		output(w, SignResponse{
+			Success:        false,
+			Status:         "signing-disabled",
+			StatusReadable: "Signed links are not enabled on this server.",
+		}, http.StatusNotImplemented)
+		return
+	}
+
+	err = auth.CheckAuthToken(sfr.Username, []byte(sfr.AuthToken))
+	if err != nil {
+		log.Debugf("%[1]s tried to authenticate as %[2]s with the wrong token.", ip, sfr.Username)
+		output(w, SignResponse{
+			Success:        false,
+			Status:         "invalid-authtoken",
+			StatusReadable: "The authentication token was incorrect. Please try logging in again.",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	img, err := database.Query(sfr.ImageName)
+	if err != nil {
+		log.Debugf("%[1]s@%[2]s attempted to sign a link to an image that doesn't exist.", sfr.Username, ip)
+		output(w, SignResponse{Success: false, Status: "not-found",
+			StatusReadable: "The image you requested a link to does not exist."}, http.StatusNotFound)
+		return
+	} else if img.Adder != sfr.Username {
+		log.Debugf("%[1]s@%[2]s attempted to sign a link to an image uploaded by %[3]s.", sfr.Username, ip, img.Adder)
+		output(w, SignResponse{Success: false, Status: "no-permissions",
+			StatusReadable: "The image you requested a link to was not uploaded by you."}, http.StatusForbidden)
+		return
+	}
+
+	params := url.Values{}
+	for key, value := range sfr.Params {
+		if !containsString(resizeKeys, key) {
+			err = fmt.Errorf("unknown parameter %s", key)
+			break
+		}
+		params.Set(key, value)
+	}
+	if err == nil && len(params) > 0 {
+		_, err = parseResizeParams(params, img.MimeType)
+	}
+	if err != nil {
+		log.Debugf("%[1]s@%[2]s sent invalid parameters for a signed link to %[3]s: %[4]s", sfr.Username, ip, img.ImageName, err)
+		output(w, SignResponse{Success: false, Status: "invalid-params",
+			StatusReadable: "The resize parameters of the link are invalid: " + err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	expiresIn := defaultLinkExpiry
+	if sfr.ExpiresIn > 0 {
+		expiresIn = time.Duration(sfr.ExpiresIn) * time.Second
+	}
+	expires := time.Now().Add(expiresIn)
+	query := signLink(img, expires, params).Encode()
+	resp := SignResponse{
+		Success:        true,
+		Status:         "signed",
+		StatusReadable: "Created a signed link to " + img.ImageName,
+		URL:            publicURL(r) + "/" + url.PathEscape(img.ImageName) + "." + img.Format + "?" + query,
+		Expires:        expires.Unix(),
+	}
+	if len(params) == 0 {
+		resp.PageURL = publicURL(r) + "/" + url.PathEscape(img.ImageName) + "?" + query
+	}
+	log.Debugf("%[1]s@%[2]s created a signed link to %[3]s that expires at %[4]d.", sfr.Username, ip, img.ImageName, resp.Expires)
+	output(w, resp, http.StatusOK)
+}
+
+// signedParams returns the resize parameters of the given query in a canonical form.
+func signedParams(query url.Values) string {
+	params := url.Values{}
+	for _, key := range resizeKeys {
+		if values, ok := query[key]; ok {
+			params[key] = values
+		}
+	}
+	return params.Encode()
+}
+
+// signature calculates the HMAC of the given image, expiry time and resize parameters with the link secret in the
+// config. The ID, uploader and upload time are signed too, so that a link doesn't work for another image that is
+// uploaded later with the same name.
+func signature(img data.ImageEntry, expires int64, params string) string {
+	mac := hmac.New(sha256.New, []byte(config.LinkSecret))
+	mac.Write([]byte(img.ImageName + "\n" + strconv.Itoa(img.ID) + "\n" + img.Adder + "\n" +
+		strconv.FormatInt(img.Timestamp, 10) + "\n" + strconv.FormatInt(expires, 10)))
+	if len(params) > 0 {
+		mac.Write([]byte("\n" + params))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signLink returns the query parameters of a signed link to the given image that is valid until the given time.
+// If the given resize parameters aren't empty, the link only works with those parameters.
+func signLink(img data.ImageEntry, expires time.Time, params url.Values) url.Values {
+	query := url.Values{}
+	for key, values := range params {
+		query[key] = values
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", signature(img, expires.Unix(), signedParams(params)))
+	return query
+}
+
+// validSignature checks if the given query contains a valid signature for the given image that hasn't expired.
+// Links signed without resize parameters work for the original image and any resized version of it, while links
+// signed with parameters only work with those parameters. Signed links are disabled if the config doesn't have a
+// link secret.
+func validSignature(query url.Values, img data.ImageEntry) bool {
+	sig := query.Get("signature")
+	if len(config.LinkSecret) == 0 || len(sig) == 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	} else if hmac.Equal([]byte(sig), []byte(signature(img, expires, ""))) {
+		return true
+	}
+	params := signedParams(query)
+	return len(params) > 0 && hmac.Equal([]byte(sig), []byte(signature(img, expires, params)))
+}
+
+// signatureQuery returns the signature parameters of the given query as a query string starting with the given
+// separator, so that addresses on a page opened with a signed link work too. An empty string is returned if the
+// query doesn't have a signature.
+func signatureQuery(query url.Values, separator string) string {
+	if len(query.Get("signature")) == 0 {
+		return ""
+	}
+	signed := url.Values{}
+	signed.Set("expires", query.Get("expires"))
+	signed.Set("signature", query.Get("signature"))
+	return separator + signed.Encode()
+}
@@ -0,0 +1,190 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: fakeHash,
+		Hidden: true, Visibility: data.VisibilityPrivate}
+	assertLink := func(prefix string, page bool) func(int, test, *testing.T, *httptest.ResponseRecorder) {
+		return func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			var received SignResponse
+			err := json.Unmarshal(recorder.Body.Bytes(), &received)
+			if err != nil {
+				t.Errorf("[%s #%d] Response JSON invalid: %s", c.path, index, err)
+				return
+			} else if recorder.Code != http.StatusOK || !received.Success {
+				t.Errorf("[%s #%d] Signing failed with %d: %s", c.path, index, recorder.Code, received.Status)
+				return
+			} else if !strings.HasPrefix(received.URL, prefix) {
+				t.Errorf("[%s #%d] URL didn't match! Expected %s..., but received %s", c.path, index, prefix, received.URL)
+			} else if (len(received.PageURL) > 0) != page {
+				t.Errorf("[%s #%d] Unexpected page URL %q", c.path, index, received.PageURL)
+			}
+			link, _ := url.Parse(received.URL)
+			if !validSignature(link.Query(), image) {
+				t.Errorf("[%s #%d] Signed link %s isn't valid", c.path, index, received.URL)
+			}
+		}
+	}
+	signing := &data.Configuration{LinkSecret: "fakeSecret", PublicURL: "https://i.example.com",
+		Resize: data.ResizeConfig{Sizes: []string{"400x300"}}}
+	cases := []test{{
+		action: "GET", path: "/sign", assert: defaultAssert,
+		status:   http.StatusMethodNotAllowed,
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\"}",
+		status:   http.StatusNotImplemented,
+		expected: &GenericResponse{Success: false, Status: "signing-disabled"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		// The expiry time would overflow.
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\",\"expires-in\":9223372036854775807}",
+		status:   http.StatusBadRequest,
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\",\"expires-in\":31536001}",
+		status:   http.StatusBadRequest,
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\"}",
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "invalid-authtoken"},
+		config:   signing,
+		auth:     fakeAuth{authTokenError: errors.New("fakeError")},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\"}",
+		status:   http.StatusNotFound,
+		expected: &GenericResponse{Success: false, Status: "not-found"},
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryError: errors.New("fakeError")},
+	}, {
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser2\",\"auth-token\":\"fakeAuthToken\"}",
+		status:   http.StatusForbidden,
+		expected: &GenericResponse{Success: false, Status: "no-permissions"},
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\",\"params\":{\"w\":\"123\"}}",
+		status:   http.StatusBadRequest,
+		expected: &GenericResponse{Success: false, Status: "invalid-params"},
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\",\"params\":{\"raw\":\"1\"}}",
+		status:   http.StatusBadRequest,
+		expected: &GenericResponse{Success: false, Status: "invalid-params"},
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: assertLink("https://i.example.com/fakeImage.png?expires=", true),
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\",\"expires-in\":60}",
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "POST", path: "/sign", assert: assertLink("https://i.example.com/fakeImage.png?expires=", false),
+		request:  "{\"image-name\":\"fakeImage\",\"username\":\"fakeUser\",\"auth-token\":\"fakeAuthToken\",\"params\":{\"w\":\"400\",\"h\":\"300\"}}",
+		config:   signing,
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestValidSignature(t *testing.T) {
+	config = &data.Configuration{LinkSecret: "fakeSecret"}
+	expires := time.Now().Add(time.Hour)
+	resized := url.Values{"w": {"400"}, "h": {"300"}}
+	withParams := func(query url.Values, key, value string) url.Values {
+		copied := url.Values{}
+		for k, v := range query {
+			copied[k] = v
+		}
+		copied.Set(key, value)
+		return copied
+	}
+	image := data.ImageEntry{ImageName: "fakeImage", ID: 1, Adder: "fakeUser", Timestamp: 1500000000}
+	other := image
+	other.ImageName = "otherImage"
+	// The name was freed by deleting the image and then used by another user.
+	reused := data.ImageEntry{ImageName: "fakeImage", ID: 99, Adder: "fakeUser2", Timestamp: 1600000000}
+	unrestricted := signLink(image, expires, nil)
+	restricted := signLink(image, expires, resized)
+	cases := []struct {
+		query url.Values
+		image data.ImageEntry
+		valid bool
+	}{
+		{unrestricted, image, true},
+		{unrestricted, other, false},
+		{unrestricted, reused, false},
+		// Links without resize parameters work for resized versions too.
+		{withParams(unrestricted, "w", "400"), image, true},
+		{restricted, image, true},
+		{restricted, reused, false},
+		{withParams(restricted, "fmt", "jpeg"), image, false},
+		{url.Values{"expires": restricted["expires"], "signature": restricted["signature"]}, image, false},
+		{withParams(unrestricted, "expires", "1"), image, false},
+		{url.Values{}, image, false},
+	}
+	for index, c := range cases {
+		if valid := validSignature(c.query, c.image); valid != c.valid {
+			t.Errorf("[#%d] Expected %v for %s, but received %v", index+1, c.valid, c.query.Encode(), valid)
+		}
+	}
+}
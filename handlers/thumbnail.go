@@ -0,0 +1,198 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"maunium.net/go/mauimageserver/data"
+	"maunium.net/go/mauimageserver/imaging"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultThumbnailSizes are the thumbnail sizes used if the config doesn't have any.
+var defaultThumbnailSizes = []int{256, 1024}
+
+// thumbnailSizes returns the configured thumbnail sizes from smallest to largest.
+// A missing config option means the default sizes, while an empty list disables thumbnails.
+func thumbnailSizes() []int {
+	if config.ThumbnailSizes == nil {
+		return defaultThumbnailSizes
+	}
+	sizes := make([]int, 0, len(config.ThumbnailSizes))
+	for _, size := range config.ThumbnailSizes {
+		if size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+// thumbnailURL returns the address of the thumbnail of the given image. If largest is true, the largest thumbnail
+// size is used, otherwise the smallest. If thumbnails are disabled, an empty string is returned.
+func thumbnailURL(imageName string, largest bool) string {
+	sizes := thumbnailSizes()
+	if len(sizes) == 0 {
+		return ""
+	}
+	size := sizes[0]
+	if largest {
+		size = sizes[len(sizes)-1]
+	}
+	return "/thumb/" + url.PathEscape(imageName) + "?size=" + strconv.Itoa(size)
+}
+
+// generateThumbnails stores thumbnails of the given image in all the configured sizes.
+// Errors are only logged, as the original image is served if a thumbnail doesn't exist.
+func generateThumbnails(image data.ImageEntry, file io.ReadSeeker) {
+	sizes := thumbnailSizes()
+	if len(sizes) == 0 || len(image.Hash) == 0 {
+		return
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		log.Errorf("Failed to generate thumbnails of %[1]s: %[2]s", image.ImageName, err)
+		return
+	}
+	img, _, err := imaging.Decode(file)
+	if err != nil {
+		// Most likely a format that can't be decoded without external libraries.
+		log.Debugf("Not generating thumbnails of %[1]s: %[2]s", image.ImageName, err)
+		return
+	}
+	for _, size := range sizes {
+		var buf bytes.Buffer
+		err = imaging.Encode(&buf, imaging.Thumbnail(img, size), image.ThumbnailFormat(), 0)
+		if err == nil {
+			err = store.Put(image.ThumbnailName(size), &buf)
+		}
+		if err != nil {
+			log.Errorf("Failed to save %[2]dpx thumbnail of %[1]s: %[3]s", image.ImageName, size, err)
+		}
+	}
+}
+
+// hasThumbnails checks if thumbnails were generated for the given image. Only images that imaging.Decode supports
+// have thumbnails.
+func hasThumbnails(image data.ImageEntry) bool {
+	switch image.MimeType {
+	case "jpeg", "png", "gif":
+		return len(image.Hash) > 0 && image.Width > 0 && image.Height > 0 && len(thumbnailSizes()) > 0
+	default:
+		return false
+	}
+}
+
+// removeThumbnails removes all the thumbnails of the given image from the image store.
+func removeThumbnails(image data.ImageEntry) {
+	if len(image.Hash) == 0 {
+		return
+	}
+	for _, size := range thumbnailSizes() {
+		err := store.Delete(image.ThumbnailName(size))
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove %[2]dpx thumbnail of %[1]s: %[3]s", image.ImageName, size, err)
+		}
+	}
+}
+
+// Thumbnail handles thumbnail requests (/thumb/{name}?size={size}).
+//
+// The size must be one of the configured thumbnail sizes and defaults to the smallest size. If the image doesn't
+// have a thumbnail (e.g. because it's in a format that can't be decoded), the original image is sent instead.
+func Thumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Add("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/thumb/")
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		name = name[:dot]
+	}
+
+	sizes := thumbnailSizes()
+	var size int
+	if len(sizes) > 0 {
+		size = sizes[0]
+	}
+	if sizeStr := r.URL.Query().Get("size"); len(sizeStr) > 0 {
+		size, _ = strconv.Atoi(sizeStr)
+		if !containsInt(sizes, size) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	img, err := database.Query(name)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if !checkView(w, r, img) || !checkExpiry(w, img) || !checkPassword(w, r, img) {
+		return
+	}
+
+	contentType := "image/" + img.ThumbnailFormat()
+	etag := imageETag(img, "thumb"+strconv.Itoa(size))
+	var file data.ImageFile
+	err = os.ErrNotExist
+	if size > 0 && len(img.Hash) > 0 {
+		file, err = store.Open(img.ThumbnailName(size))
+	}
+	if os.IsNotExist(err) {
+		contentType = img.ContentType()
+		etag = imageETag(img, "")
+		file, err = store.Open(img.FileName())
+	}
+	if err != nil {
+		log.Errorf("Failed to read thumbnail of %[2]s requested by %[1]s: %[3]s", getIP(r), name, err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	if !countView(w, r, img, etag, imageModified(img)) {
+		return
+	}
+	serveImage(w, r, file, contentType, etag, imageModified(img))
+}
+
+func containsInt(list []int, value int) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"errors"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func assertFile(contentType, body string) func(int, test, *testing.T, *httptest.ResponseRecorder) {
+	return func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+		if recorder.Code != c.status {
+			t.Errorf("[%s #%d] Status code didn't match! Expected %d, but received %d", c.path, index, c.status, recorder.Code)
+		} else if received := recorder.Header().Get("Content-Type"); received != contentType {
+			t.Errorf("[%s #%d] Content type didn't match! Expected %s, but received %s", c.path, index, contentType, received)
+		} else if recorder.Body.String() != body {
+			t.Errorf("[%s #%d] Body didn't match! Expected %q, but received %q", c.path, index, body, recorder.Body.String())
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Hash: fakeHash}
+	cases := []test{{
+		action: "POST", path: "/thumb/fakeImage", assert: defaultAssert,
+		status:   http.StatusMethodNotAllowed,
+		config:   &data.Configuration{},
+		database: fakeDatabase{},
+	}, {
+		action: "GET", path: "/thumb/fakeImage?size=123", assert: defaultAssert,
+		status:   http.StatusBadRequest,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image},
+	}, {
+		action: "GET", path: "/thumb/fakeImage", assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryError: errors.New("fakeError")},
+	}, {
+		action: "GET", path: "/thumb/fakeImage.png?size=1024",
+		assert:   assertFile("image/png", "largeThumbnail"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: image},
+		store: fakeStore{files: map[string]string{
+			image.ThumbnailName(256):  "smallThumbnail",
+			image.ThumbnailName(1024): "largeThumbnail",
+		}},
+	}, {
+		action: "GET", path: "/thumb/fakeImage",
+		assert:   assertFile("image/png", "thumbnail"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{ThumbnailSizes: []int{64}},
+		database: fakeDatabase{queryImage: image},
+		store:    fakeStore{files: map[string]string{image.ThumbnailName(64): "thumbnail"}},
+	}, {
+		// Images that couldn't be decoded don't have thumbnails, so the original is sent.
+		action: "GET", path: "/thumb/fakeImage",
+		assert:   assertFile("image/gif", "original"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{},
+		database: fakeDatabase{queryImage: data.ImageEntry{ImageName: "fakeImage", Format: "gif", MimeType: "gif", Hash: fakeHash}},
+		store:    fakeStore{files: map[string]string{data.BlobName(fakeHash): "original"}},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
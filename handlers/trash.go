@@ -0,0 +1,171 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"time"
+)
+
+// defaultTrashRetention is how long deleted images are kept in the trash if the config doesn't specify it.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashEnabled checks if deleted images are moved to the trash. A negative retention period disables the trash.
+func trashEnabled() bool {
+	return config.TrashRetention >= 0
+}
+
+func trashRetention() time.Duration {
+	if config.TrashRetention > 0 {
+		return time.Duration(config.TrashRetention) * time.Second
+	}
+	return defaultTrashRetention
+}
+
+// TrashForm is the form for listing the images in the trash. AuthToken is required.
+type TrashForm struct {
+	Username  string `json:"username"`
+	AuthToken string `json:"auth-token"`
+}
+
+// Trash handles requests to list the images the user has moved to the trash (POST /trash).
+func Trash(w http.ResponseWriter, r *http.Request) {
+	var ip = getIP(r)
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var tf TrashForm
+	err := decoder.Decode(&tf)
+	if err != nil || len(tf.Username) == 0 || len(tf.AuthToken) == 0 {
+		log.Debugf("%[1]s sent an invalid trash request.", ip)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = auth.CheckAuthToken(tf.Username, []byte(tf.AuthToken))
+	if err != nil {
+		log.Debugf("%[1]s tried to authenticate as %[2]s with the wrong token.", ip, tf.Username)
+		output(w, SearchResponse{
+			Success:        false,
+			Status:         "invalid-authtoken",
+			StatusReadable: "The authentication token was incorrect. Please try logging in again.",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	images, err := database.QueryTrash(tf.Username, 0)
+	if err != nil {
+		log.Errorf("Failed to list the trash of %[1]s@%[2]s: %[3]s", tf.Username, ip, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	response := SearchResponse{
+		Success:        true,
+		Status:         "success",
+		StatusReadable: fmt.Sprintf("Found %d images in the trash", len(images)),
+	}
+	for _, img := range images {
+		// Images in the trash can't be viewed, so there's no thumbnail URL.
+		response.Results = append(response.Results, SearchResult{ImageEntry: img})
+	}
+	output(w, response, http.StatusOK)
+}
+
+// Restore handles requests to move images out of the trash (POST /restore). The form is the same as for deleting.
+func Restore(w http.ResponseWriter, r *http.Request) {
+	var ip = getIP(r)
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var rf DeleteForm
+	err := decoder.Decode(&rf)
+	if err != nil || len(rf.ImageName) == 0 || len(rf.Username) == 0 || len(rf.AuthToken) == 0 {
+		log.Debugf("%[1]s sent an invalid restore request.", ip)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = auth.CheckAuthToken(rf.Username, []byte(rf.AuthToken))
+	if err != nil {
+		log.Debugf("%[1]s tried to authenticate as %[2]s with the wrong token.", ip, rf.Username)
+		output(w, GenericResponse{
+			Success:        false,
+			Status:         "invalid-authtoken",
+			StatusReadable: "The authentication token was incorrect. Please try logging in again.",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	img, err := database.QueryDeleted(rf.ImageName)
+	if err != nil {
+		log.Debugf("%[1]s@%[2]s attempted to restore an image that isn't in the trash.", rf.Username, ip)
+		output(w, GenericResponse{Success: false, Status: "not-found",
+			StatusReadable: "The image you requested to be restored is not in the trash."}, http.StatusNotFound)
+		return
+	} else if img.Adder != rf.Username {
+		log.Debugf("%[1]s@%[2]s attempted to restore an image uploaded by %[3]s.", rf.Username, ip, img.Adder)
+		output(w, GenericResponse{Success: false, Status: "no-permissions",
+			StatusReadable: "The image you requested to be restored was not uploaded by you."}, http.StatusForbidden)
+		return
+	}
+
+	err = database.Restore(rf.ImageName)
+	if err != nil {
+		log.Warnf("Error restoring %[4]s (requested by %[1]s@%[2]s): %[3]s", rf.Username, ip, err, rf.ImageName)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Debugf("%[1]s@%[2]s successfully restored the image with the name %[3]s.", rf.Username, ip, rf.ImageName)
+	output(w, GenericResponse{
+		Success:        true,
+		Status:         "restored",
+		StatusReadable: "The image " + rf.ImageName + " was successfully restored.",
+	}, http.StatusAccepted)
+}
+
+// PurgeTrash periodically removes the images that have been in the trash for longer than the retention period.
+func PurgeTrash() {
+	for {
+		if trashEnabled() {
+			images, err := database.QueryTrash("", time.Now().Add(-trashRetention()).Unix())
+			if err != nil {
+				log.Errorf("Failed to find images to purge from the trash: %[1]s", err)
+			}
+			for _, img := range images {
+				err = removeImage(img)
+				if err != nil {
+					log.Errorf("Failed to purge %[1]s from the trash: %[2]s", img.ImageName, err)
+				} else {
+					log.Debugf("Purged %[1]s from the trash", img.ImageName)
+				}
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
@@ -0,0 +1,180 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestGetTrashed(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	// The files of images in the trash stay where they are, so they must not be served through any address.
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: fakeHash, DeletedAt: 12345}
+	legacy := image
+	legacy.Hash = ""
+	files := fakeStore{files: map[string]string{image.FileName(): "image", image.ThumbnailName(256): "thumbnail",
+		legacy.FileName(): "image"}}
+	owner := map[string]string{"X-Username": "fakeUser", "X-Auth-Token": "fakeAuthToken"}
+	for index, path := range []string{
+		"/fakeImage", "/fakeImage.png", "/fakeImage/download", "/fakeImage.png?raw=1&w=10", "/thumb/fakeImage",
+		"/api/images/fakeImage", "/oembed?url=" + url.QueryEscape("https://i.example.com/fakeImage"),
+		"/" + image.FileName(), "/" + image.ThumbnailName(256),
+	} {
+		run(index+1, test{
+			action: "GET", path: path, assert: defaultAssert,
+			headers:  owner,
+			status:   http.StatusNotFound,
+			config:   &data.Configuration{},
+			auth:     fakeAuth{},
+			database: fakeDatabase{queryError: errors.New("No data found"), deletedImage: image},
+			store:    files,
+		}, t)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	cases := []test{{
+		action: "GET", path: "/trash", assert: defaultAssert,
+		request:  "",
+		status:   http.StatusMethodNotAllowed,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/trash", assert: defaultAssert,
+		request:  "{\"username\": \"fakeUser\"}",
+		status:   http.StatusBadRequest,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/trash", assert: defaultAssert,
+		request:  "{\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "invalid-authtoken"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{authTokenError: errors.New("fakeError")},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/trash", assert: defaultAssert,
+		request:  "{\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusInternalServerError,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{searchError: errors.New("fakeError")},
+	}, {
+		action: "POST", path: "/trash",
+		request:  "{\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusOK,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{searchImages: []data.ImageEntry{{ImageName: "asd", DeletedAt: 12345}}},
+		assert: func(index int, c test, t *testing.T, recorder *httptest.ResponseRecorder) {
+			var received SearchResponse
+			json.Unmarshal(recorder.Body.Bytes(), &received)
+			if !received.Success || len(received.Results) != 1 || received.Results[0].DeletedAt != 12345 ||
+				len(received.Results[0].ThumbnailURL) > 0 {
+				t.Errorf("[%s #%d] Response didn't match! Received %s", c.path, index, recorder.Body.String())
+			}
+		},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	cases := []test{{
+		action: "GET", path: "/restore", assert: defaultAssert,
+		request:  "",
+		status:   http.StatusMethodNotAllowed,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/restore", assert: defaultAssert,
+		request:  "{\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusBadRequest,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/restore", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "invalid-authtoken"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{authTokenError: errors.New("fakeError")},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/restore", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusNotFound,
+		expected: &GenericResponse{Success: false, Status: "not-found"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/restore", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusForbidden,
+		expected: &GenericResponse{Success: false, Status: "no-permissions"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{deletedImage: data.ImageEntry{ImageName: "fakeImage", Adder: "fakeUser2"}},
+	}, {
+		action: "POST", path: "/restore", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusInternalServerError,
+		expected: nil,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{deletedImage: data.ImageEntry{ImageName: "fakeImage", Adder: "fakeUser"}, trashError: errors.New("fakeError")},
+	}, {
+		action: "POST", path: "/restore", assert: defaultAssert,
+		request:  "{\"image-name\":\"fakeImage\",\"username\": \"fakeUser\",\"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusAccepted,
+		expected: &GenericResponse{Success: true, Status: "restored"},
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{deletedImage: data.ImageEntry{ImageName: "fakeImage", Adder: "fakeUser"}},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
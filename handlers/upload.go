@@ -0,0 +1,314 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadForm is the form for creating resumable uploads. It contains the same fields as InsertForm
+// (except the image itself) and the total length of the image.
+type UploadForm struct {
+	InsertForm
+	Length int64 `json:"upload-length"`
+}
+
+// upload is the state of a resumable upload, stored next to the partial image as JSON.
+type upload struct {
+	Form   InsertForm `json:"form"`
+	Length int64      `json:"length"`
+	// PasswordHash is the hashed password of the image, as it's not included in the JSON of the form.
+	PasswordHash string `json:"password-hash,omitempty"`
+}
+
+// uploadLocks contains the IDs of uploads that are currently receiving data.
+var uploadLocks = make(map[string]bool)
+var uploadLocksLock sync.Mutex
+
+func lockUpload(id string) bool {
+	uploadLocksLock.Lock()
+	defer uploadLocksLock.Unlock()
+	if uploadLocks[id] {
+		return false
+	}
+	uploadLocks[id] = true
+	return true
+}
+
+func unlockUpload(id string) {
+	uploadLocksLock.Lock()
+	delete(uploadLocks, id)
+	uploadLocksLock.Unlock()
+}
+
+func uploadLocation() string {
+	if len(config.UploadLocation) > 0 {
+		return config.UploadLocation
+	}
+	return filepath.Join(os.TempDir(), "mis-uploads")
+}
+
+func uploadExpiry() time.Duration {
+	if config.UploadExpiry > 0 {
+		return time.Duration(config.UploadExpiry) * time.Second
+	}
+	return 24 * time.Hour
+}
+
+func uploadPath(id, ext string) string {
+	return filepath.Join(uploadLocation(), id+ext)
+}
+
+func validUploadID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil
+}
+
+// Upload handles resumable upload requests.
+//
+// POST /upload creates an upload and returns its ID. PATCH /upload/{id} appends data to the upload at the offset
+// given in the Upload-Offset header, HEAD /upload/{id} returns the current offset and DELETE /upload/{id} cancels
+// the upload. Once all data has been received, the image is saved like with a normal insert request.
+func Upload(w http.ResponseWriter, r *http.Request) {
+	var ip = getIP(r)
+	if r.URL.Path == "/upload" {
+		if r.Method != "POST" {
+			w.Header().Add("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		createUpload(w, r, ip)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/upload/")
+	if !validUploadID(id) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		headUpload(w, id)
+	case "PATCH":
+		patchUpload(w, r, ip, id)
+	case "DELETE":
+		deleteUpload(w, ip, id)
+	default:
+		w.Header().Add("Allow", "HEAD, PATCH, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request, ip string) {
+	// Create a json decoder for the payload.
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 64*1024))
+	var uf UploadForm
+	// Decode the payload.
+	err := decoder.Decode(&uf)
+	if err != nil || uf.Length <= 0 {
+		log.Debugf("%[1]s sent an invalid upload creation request.", ip)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if config.MaxUploadSize > 0 && uf.Length > config.MaxUploadSize {
+		log.Debugf("%[1]s tried to create an upload that is too large.", ip)
+		outputTooLarge(w, config.MaxUploadSize)
+		return
+	}
+
+	if !authenticateInsert(w, ip, &uf.InsertForm) {
+		return
+	} else if _, ok := checkOwner(w, ip, uf.ImageName, uf.Username); !ok {
+		return
+	}
+	// The token has been checked, there's no need to store it.
+	uf.AuthToken = ""
+
+	idBytes := make([]byte, 16)
+	_, err = rand.Read(idBytes)
+	if err == nil {
+		err = os.MkdirAll(uploadLocation(), 0700)
+	}
+	id := hex.EncodeToString(idBytes)
+	var state []byte
+	if err == nil {
+		state, err = json.Marshal(upload{Form: uf.InsertForm, Length: uf.Length, PasswordHash: uf.passwordHash})
+	}
+	if err == nil {
+		err = ioutil.WriteFile(uploadPath(id, ".part"), nil, 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(uploadPath(id, ".json"), state, 0600)
+	}
+	if err != nil {
+		log.Errorf("Error while creating upload for %[1]s@%[2]s: %[3]s", uf.Username, ip, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Debugf("%[1]s@%[2]s created upload %[3]s for %[4]d bytes.", uf.Username, ip, id, uf.Length)
+	w.Header().Set("Location", "/upload/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	output(w, GenericResponse{
+		Success:        true,
+		Status:         "upload-created",
+		StatusReadable: "The upload was created. Send the image with PATCH requests to /upload/" + id,
+		ImageName:      uf.ImageName,
+		UploadID:       id,
+	}, http.StatusCreated)
+}
+
+func readUpload(id string) (state upload, offset int64, err error) {
+	data, err := ioutil.ReadFile(uploadPath(id, ".json"))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(uploadPath(id, ".part"))
+	if err != nil {
+		return
+	}
+	return state, info.Size(), nil
+}
+
+func removeUpload(id string) {
+	os.Remove(uploadPath(id, ".part"))
+	os.Remove(uploadPath(id, ".json"))
+}
+
+func headUpload(w http.ResponseWriter, id string) {
+	state, offset, err := readUpload(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(state.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteUpload(w http.ResponseWriter, ip, id string) {
+	if !lockUpload(id) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer unlockUpload(id)
+	if _, _, err := readUpload(id); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	removeUpload(id)
+	log.Debugf("%[1]s cancelled upload %[2]s.", ip, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func patchUpload(w http.ResponseWriter, r *http.Request, ip, id string) {
+	if !lockUpload(id) {
+		// Another request is already writing to this upload.
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer unlockUpload(id)
+
+	state, offset, err := readUpload(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if requestOffset != offset {
+		// The client has the wrong offset, it needs to check the current one with a HEAD request.
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	file, err := os.OpenFile(uploadPath(id, ".part"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Errorf("Failed to open upload %[1]s: %[2]s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// Extra data after the declared length is ignored. If the request is interrupted, everything received so far is kept.
+	n, copyErr := io.Copy(file, io.LimitReader(r.Body, state.Length-offset))
+	err = file.Close()
+	offset += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if err != nil {
+		log.Errorf("Failed to write to upload %[1]s: %[2]s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if copyErr != nil {
+		log.Debugf("%[1]s@%[2]s was interrupted while sending data to upload %[3]s: %[4]s", state.Form.Username, ip, id, copyErr)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if offset < state.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// The upload is complete, save it like a normal image.
+	log.Debugf("%[1]s@%[2]s finished upload %[3]s.", state.Form.Username, ip, id)
+	image, err := os.Open(uploadPath(id, ".part"))
+	if err != nil {
+		log.Errorf("Failed to open upload %[1]s: %[2]s", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	state.Form.passwordHash = state.PasswordHash
+	saveImage(w, ip, state.Form, image)
+	image.Close()
+	removeUpload(id)
+}
+
+// ExpireUploads periodically removes resumable uploads that haven't received any data within the upload expiry time.
+func ExpireUploads() {
+	for {
+		files, _ := filepath.Glob(filepath.Join(uploadLocation(), "*.json"))
+		for _, file := range files {
+			id := strings.TrimSuffix(filepath.Base(file), ".json")
+			info, err := os.Stat(uploadPath(id, ".part"))
+			if (err == nil && time.Since(info.ModTime()) > uploadExpiry()) || os.IsNotExist(err) {
+				if lockUpload(id) {
+					log.Debugf("Removing expired upload %s", id)
+					removeUpload(id)
+					unlockUpload(id)
+				}
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
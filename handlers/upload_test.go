@@ -0,0 +1,175 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUpload(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	dir, err := ioutil.TempDir("", "mis-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []test{{
+		action: "GET", path: "/upload", assert: defaultAssert,
+		request:  "",
+		status:   http.StatusMethodNotAllowed,
+		expected: nil,
+		config:   &data.Configuration{UploadLocation: dir},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/upload", assert: defaultAssert,
+		request:  "{\"image-name\": \"fakeImage\"}",
+		status:   http.StatusBadRequest,
+		expected: nil,
+		config:   &data.Configuration{UploadLocation: dir},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/upload", assert: defaultAssert,
+		request:  "{\"upload-length\": 1000}",
+		status:   http.StatusRequestEntityTooLarge,
+		expected: &GenericResponse{Success: false, Status: "too-large"},
+		config:   &data.Configuration{UploadLocation: dir, MaxUploadSize: 100},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/upload", assert: defaultAssert,
+		request:  "{\"upload-length\": 1000}",
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "not-logged-in"},
+		config:   &data.Configuration{UploadLocation: dir, RequireAuth: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/upload", assert: defaultAssert,
+		request:  "{\"upload-length\": 1000, \"username\": \"fakeUser\", \"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusUnauthorized,
+		expected: &GenericResponse{Success: false, Status: "invalid-authtoken"},
+		config:   &data.Configuration{UploadLocation: dir, RequireAuth: true},
+		auth:     fakeAuth{authTokenError: errors.New("fakeError")},
+		database: fakeDatabase{},
+	}, {
+		action: "POST", path: "/upload", assert: defaultAssert,
+		request:  "{\"upload-length\": 1000, \"image-name\": \"fakeImage\", \"username\": \"fakeUser\", \"auth-token\": \"fakeAuthToken\"}",
+		status:   http.StatusForbidden,
+		expected: &GenericResponse{Success: false, Status: "already-exists"},
+		config:   &data.Configuration{UploadLocation: dir, RequireAuth: true},
+		auth:     fakeAuth{},
+		database: fakeDatabase{imageOwner: "fakeUser2"},
+	}, {
+		action: "POST", path: "/upload", assert: defaultAssert,
+		request:  "{\"upload-length\": 1000}",
+		status:   http.StatusCreated,
+		expected: &GenericResponse{Success: true, Status: "upload-created"},
+		config:   &data.Configuration{UploadLocation: dir},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "HEAD", path: "/upload/00000000000000000000000000000000", assert: defaultAssert,
+		request:  "",
+		status:   http.StatusNotFound,
+		expected: nil,
+		config:   &data.Configuration{UploadLocation: dir},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}, {
+		action: "PATCH", path: "/upload/../../etc/passwd", assert: defaultAssert,
+		request:  "",
+		status:   http.StatusNotFound,
+		expected: nil,
+		config:   &data.Configuration{UploadLocation: dir},
+		auth:     fakeAuth{},
+		database: fakeDatabase{},
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	dir, err := ioutil.TempDir("", "mis-test-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	Init(&data.Configuration{UploadLocation: dir}, fakeDatabase{}, fakeStore{}, fakeAuth{})
+
+	send := func(method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.RemoteAddr = "fakeIP"
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		Upload(recorder, req)
+		return recorder
+	}
+
+	img := rawImage()
+	resp := send("POST", "/upload", "{\"image-name\": \"fakeImage\", \"upload-length\": "+strconv.Itoa(len(img))+"}", nil)
+	var created GenericResponse
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	if resp.Code != http.StatusCreated || len(created.UploadID) == 0 {
+		t.Fatalf("Failed to create upload: %d %s", resp.Code, resp.Body.String())
+	}
+	path := "/upload/" + created.UploadID
+
+	resp = send("PATCH", path, img[:20], map[string]string{"Upload-Offset": "0"})
+	if resp.Code != http.StatusNoContent || resp.Header().Get("Upload-Offset") != "20" {
+		t.Errorf("Unexpected response to first chunk: %d with offset %s", resp.Code, resp.Header().Get("Upload-Offset"))
+	}
+	resp = send("PATCH", path, img[10:], map[string]string{"Upload-Offset": "10"})
+	if resp.Code != http.StatusConflict || resp.Header().Get("Upload-Offset") != "20" {
+		t.Errorf("Unexpected response to chunk with wrong offset: %d with offset %s", resp.Code, resp.Header().Get("Upload-Offset"))
+	}
+	resp = send("HEAD", path, "", nil)
+	if resp.Code != http.StatusOK || resp.Header().Get("Upload-Offset") != "20" || resp.Header().Get("Upload-Length") != strconv.Itoa(len(img)) {
+		t.Errorf("Unexpected response to HEAD: %d with offset %s", resp.Code, resp.Header().Get("Upload-Offset"))
+	}
+
+	resp = send("PATCH", path, img[20:], map[string]string{"Upload-Offset": "20"})
+	var finished GenericResponse
+	json.Unmarshal(resp.Body.Bytes(), &finished)
+	if resp.Code != http.StatusCreated || finished.Status != "created" || finished.ImageName != "fakeImage" {
+		t.Errorf("Unexpected response to last chunk: %d %s", resp.Code, resp.Body.String())
+	}
+	resp = send("HEAD", path, "", nil)
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Finished upload wasn't removed: HEAD returned %d", resp.Code)
+	}
+}
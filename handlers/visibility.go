@@ -0,0 +1,79 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"maunium.net/go/mauimageserver/data"
+	"net/http"
+)
+
+// defaultUnlistedNameLength is the length of generated names for unlisted and private images if the config doesn't
+// have one. Public images have short names, but unlisted images can only be found by guessing the name.
+const defaultUnlistedNameLength = 12
+
+// maxImageNameLength is the length of the image name column in the database.
+const maxImageNameLength = 32
+
+func unlistedNameLength() int {
+	if config.UnlistedNameLength > maxImageNameLength {
+		return maxImageNameLength
+	} else if config.UnlistedNameLength > 0 {
+		return config.UnlistedNameLength
+	}
+	return defaultUnlistedNameLength
+}
+
+// requestUser checks the X-Username and X-Auth-Token headers of the given request. An empty username is returned
+// if the headers aren't set, and an error is returned if the token is incorrect.
+func requestUser(r *http.Request) (string, error) {
+	username := r.Header.Get("X-Username")
+	authToken := r.Header.Get("X-Auth-Token")
+	if len(username) == 0 || len(authToken) == 0 {
+		return "", nil
+	}
+	err := auth.CheckAuthToken(username, []byte(authToken))
+	if err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// canView checks if the sender of the given request is allowed to view the given image. Private images can only be
+// viewed by the uploader or with a signed link.
+func canView(r *http.Request, img data.ImageEntry) bool {
+	if img.Visibility != data.VisibilityPrivate {
+		return true
+	} else if validSignature(r.URL.Query(), img) {
+		return true
+	}
+	username, err := requestUser(r)
+	return err == nil && len(username) > 0 && username == img.Adder
+}
+
+// checkView makes sure that the sender of the given request is allowed to view the given image. If not, 404 is sent
+// to the given ResponseWriter, as private images shouldn't be distinguishable from images that don't exist.
+// Responses with private images are marked as private so that shared caches don't store them.
+func checkView(w http.ResponseWriter, r *http.Request, img data.ImageEntry) bool {
+	if !canView(r, img) {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	} else if img.Visibility == data.VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	return true
+}
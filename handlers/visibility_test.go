@@ -0,0 +1,129 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package handlers contains the MIS-specific HTTP request handlers
+package handlers
+
+import (
+	"maunium.net/go/mauimageserver/data"
+	log "maunium.net/go/maulogger"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPrivate(t *testing.T) {
+	log.InitWithWriter(nil)
+	log.PrintLevel = 9002
+	config = &data.Configuration{LinkSecret: "fakeSecret"}
+	image := data.ImageEntry{ImageName: "fakeImage", Format: "png", MimeType: "png", Adder: "fakeUser", Hash: fakeHash,
+		Hidden: true, Visibility: data.VisibilityPrivate, ID: 1}
+	signed := signLink(image, time.Now().Add(time.Hour), nil).Encode()
+	expired := signLink(image, time.Now().Add(-time.Hour), nil).Encode()
+	reused := image
+	reused.Adder, reused.ID = "fakeUser2", 99
+	files := fakeStore{files: map[string]string{image.FileName(): "fakeImageData"}}
+	owner := map[string]string{"X-Username": "fakeUser", "X-Auth-Token": "fakeAuthToken"}
+	cases := []test{{
+		action: "GET", path: "/fakeImage.png", assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{LinkSecret: "fakeSecret"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png", assert: assertFile("image/png", "fakeImageData"),
+		headers:  owner,
+		status:   http.StatusOK,
+		config:   &data.Configuration{LinkSecret: "fakeSecret"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png?" + signed, assert: assertFile("image/png", "fakeImageData"),
+		status:   http.StatusOK,
+		config:   &data.Configuration{LinkSecret: "fakeSecret"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/fakeImage.png?" + expired, assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{LinkSecret: "fakeSecret"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		// The link was signed for an image that had the same name before, but has since been deleted.
+		action: "GET", path: "/fakeImage.png?" + signed, assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{LinkSecret: "fakeSecret"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: reused, exactQuery: true},
+		store:    files,
+	}, {
+		// Signed links don't work without a secret.
+		action: "GET", path: "/fakeImage.png?" + signed, assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image, exactQuery: true},
+		store:    files,
+	}, {
+		action: "GET", path: "/thumb/fakeImage", assert: defaultAssert,
+		status:   http.StatusNotFound,
+		config:   &data.Configuration{LinkSecret: "fakeSecret"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+		store:    files,
+	}, {
+		action: "GET", path: "/thumb/fakeImage", assert: assertFile("image/png", "fakeImageData"),
+		headers:  owner,
+		status:   http.StatusOK,
+		config:   &data.Configuration{LinkSecret: "fakeSecret"},
+		auth:     fakeAuth{},
+		database: fakeDatabase{queryImage: image},
+		store:    files,
+	}}
+
+	for index, c := range cases {
+		run(index+1, c, t)
+	}
+}
+
+func TestUnlistedNameLength(t *testing.T) {
+	for configured, expected := range map[int]int{0: defaultUnlistedNameLength, 20: 20, 100: maxImageNameLength} {
+		config = &data.Configuration{UnlistedNameLength: configured}
+		if length := unlistedNameLength(); length != expected {
+			t.Errorf("Name length with %d configured didn't match! Expected %d, but received %d", configured, expected, length)
+		}
+	}
+}
+
+func TestImageName(t *testing.T) {
+	for _, length := range []int{5, defaultUnlistedNameLength} {
+		name := ImageName(length)
+		if len(name) != length {
+			t.Errorf("Name length didn't match! Expected %d, but received %d (%s)", length, len(name), name)
+		}
+		for _, char := range name {
+			if !strings.ContainsRune(imageNameAC, char) {
+				t.Errorf("Name %s contains an invalid character %c", name, char)
+			}
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package imaging contains the pure-Go image decoding, resizing and encoding used for thumbnails and resizing.
+package imaging
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+)
+
+// MaxPixels is the maximum number of pixels in an image that Decode will decode.
+// Without a limit, a tiny file could claim to be a huge image and use all the memory of the server.
+const MaxPixels = 64 * 1024 * 1024
+
+// ErrTooLarge is returned by Decode if the image has more than MaxPixels pixels.
+var ErrTooLarge = errors.New("image dimensions too large")
+
+// Decode decodes a PNG, JPEG or GIF image. The name of the format is returned with the image.
+func Decode(r io.ReadSeeker) (image.Image, string, error) {
+	conf, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", err
+	} else if int64(conf.Width)*int64(conf.Height) > MaxPixels {
+		return nil, format, ErrTooLarge
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, format, err
+	}
+	return image.Decode(r)
+}
+
+// Dimensions reads the width and height of a PNG, JPEG, GIF or WebP image without decoding the pixels.
+func Dimensions(r io.Reader) (int, int, error) {
+	reader := bufio.NewReader(r)
+	header, _ := reader.Peek(30)
+	if len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP" {
+		return webpDimensions(header)
+	}
+	conf, _, err := image.DecodeConfig(reader)
+	return conf.Width, conf.Height, err
+}
+
+// webpDimensions reads the size of a WebP image from the first 30 bytes of the file.
+func webpDimensions(header []byte) (int, int, error) {
+	if len(header) < 30 {
+		return 0, 0, errInvalidWebP
+	}
+	data := header[20:]
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// Lossy: frame tag (3 bytes), start code (3 bytes), then 14-bit width and height.
+		if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return 0, 0, errInvalidWebP
+		}
+		return int(binary.LittleEndian.Uint16(data[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(data[8:]) & 0x3fff), nil
+	case "VP8L":
+		// Lossless: signature byte, then 14-bit width-1 and height-1.
+		if data[0] != 0x2f {
+			return 0, 0, errInvalidWebP
+		}
+		bits := binary.LittleEndian.Uint32(data[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	case "VP8X":
+		// Extended: flags (4 bytes), then 24-bit canvas width-1 and height-1.
+		return int(uint24(data[4:])) + 1, int(uint24(data[7:])) + 1, nil
+	default:
+		return 0, 0, errInvalidWebP
+	}
+}
+
+var errInvalidWebP = errors.New("invalid WebP header")
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// Encode writes the given image to the given writer in the given format (jpeg, png or gif).
+// The quality is only used for JPEG, and zero means the default quality.
+func Encode(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case "jpeg", "jpg":
+		if quality <= 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported image format %s", format)
+	}
+}
+
+// Fit returns the largest size with the same aspect ratio as the given size that fits in maxWidth×maxHeight.
+// Sizes that already fit are returned as-is, as images are never enlarged.
+func Fit(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	} else if width*maxHeight > height*maxWidth {
+		return maxWidth, atLeastOne(height * maxWidth / width)
+	}
+	return atLeastOne(width * maxHeight / height), maxHeight
+}
+
+// Thumbnail scales the given image down so that it fits in a size×size square.
+func Thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := Fit(bounds.Dx(), bounds.Dy(), size, size)
+	return Resize(img, width, height)
+}
+
+// The ways Transform can fit an image into the requested size.
+const (
+	// FitContain scales the image to fit inside the requested size, keeping the aspect ratio.
+	FitContain = "contain"
+	// FitCover scales the image to cover the requested size, keeping the aspect ratio and cropping the overflow.
+	FitCover = "cover"
+	// FitFill scales the image to exactly the requested size, ignoring the aspect ratio.
+	FitFill = "fill"
+)
+
+// Transform scales the given image to the given size using the given fit mode.
+// A zero width or height means that dimension isn't limited. Images are never enlarged.
+func Transform(img image.Image, width, height int, fit string) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if width <= 0 {
+		width = srcWidth
+	}
+	if height <= 0 {
+		height = srcHeight
+	}
+	switch fit {
+	case FitFill:
+		width, height = minInt(width, srcWidth), minInt(height, srcHeight)
+	case FitCover:
+		// Scale so that the smaller side fits, then crop the larger side from the center.
+		scaledWidth, scaledHeight := srcWidth, srcHeight
+		if srcWidth*height > srcHeight*width {
+			scaledWidth, scaledHeight = Fit(srcWidth, srcHeight, srcWidth, height)
+		} else {
+			scaledWidth, scaledHeight = Fit(srcWidth, srcHeight, width, srcHeight)
+		}
+		if scaledWidth != srcWidth || scaledHeight != srcHeight {
+			img = Resize(img, scaledWidth, scaledHeight)
+		}
+		return crop(img, minInt(width, scaledWidth), minInt(height, scaledHeight))
+	default:
+		width, height = Fit(srcWidth, srcHeight, width, height)
+	}
+	if width == srcWidth && height == srcHeight {
+		return img
+	}
+	return Resize(img, width, height)
+}
+
+// crop cuts the given size out of the center of the given image.
+func crop(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	x := bounds.Min.X + (bounds.Dx()-width)/2
+	y := bounds.Min.Y + (bounds.Dy()-height)/2
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), img, image.Pt(x, y), draw.Src)
+	return dst
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func atLeastOne(value int) int {
+	if value < 1 {
+		return 1
+	}
+	return value
+}
+
+// span contains the weights of the source pixels that are used for one destination pixel.
+type span struct {
+	start   int
+	weights []float32
+}
+
+// spans calculates the weights for scaling srcSize pixels to dstSize pixels with a triangle filter.
+// When shrinking, the filter is widened so that every source pixel contributes to the result.
+func spans(srcSize, dstSize int) []span {
+	scale := float64(srcSize) / float64(dstSize)
+	radius := math.Max(scale, 1)
+	result := make([]span, dstSize)
+	for i := range result {
+		center := (float64(i)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - radius))
+		end := int(math.Floor(center + radius))
+		if start < 0 {
+			start = 0
+		}
+		if end > srcSize-1 {
+			end = srcSize - 1
+		}
+		weights := make([]float32, 0, end-start+1)
+		var sum float64
+		for j := start; j <= end; j++ {
+			weight := math.Max(1-math.Abs(float64(j)-center)/radius, 0)
+			weights = append(weights, float32(weight))
+			sum += weight
+		}
+		for j := range weights {
+			weights[j] /= float32(sum)
+		}
+		result[i] = span{start: start, weights: weights}
+	}
+	return result
+}
+
+// Resize scales the given image to the given size. The aspect ratio is not preserved, see Fit.
+func Resize(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		// Convert everything to premultiplied RGBA, which can be filtered linearly.
+		src = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+
+	// Scale horizontally into a temporary buffer first, then vertically into the result.
+	tmp := make([]float32, width*srcHeight*4)
+	xSpans := spans(srcWidth, width)
+	for y := 0; y < srcHeight; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, s := range xSpans {
+			out := tmp[(y*width+x)*4:]
+			for i, weight := range s.weights {
+				pixel := row[(s.start+i)*4:]
+				for c := 0; c < 4; c++ {
+					out[c] += weight * float32(pixel[c])
+				}
+			}
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, s := range spans(srcHeight, height) {
+		for x := 0; x < width; x++ {
+			var sum [4]float32
+			for i, weight := range s.weights {
+				pixel := tmp[((s.start+i)*width+x)*4:]
+				for c := 0; c < 4; c++ {
+					sum[c] += weight * pixel[c]
+				}
+			}
+			out := dst.Pix[y*dst.Stride+x*4:]
+			alpha := toByte(sum[3])
+			for c := 0; c < 3; c++ {
+				// Rounding errors must not make the premultiplied color larger than the alpha.
+				out[c] = minByte(toByte(sum[c]), alpha)
+			}
+			out[3] = alpha
+		}
+	}
+	return dst
+}
+
+func toByte(value float32) uint8 {
+	if value <= 0 {
+		return 0
+	} else if value >= 255 {
+		return 255
+	}
+	return uint8(value + 0.5)
+}
+
+func minByte(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,142 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package imaging contains the pure-Go image decoding, resizing and encoding used for thumbnails and resizing.
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	cases := []struct {
+		width, height, maxWidth, maxHeight int
+		expectedWidth, expectedHeight      int
+	}{
+		{100, 50, 200, 200, 100, 50},
+		{400, 200, 200, 200, 200, 100},
+		{200, 400, 200, 200, 100, 200},
+		{1000, 1, 100, 100, 100, 1},
+	}
+	for index, c := range cases {
+		width, height := Fit(c.width, c.height, c.maxWidth, c.maxHeight)
+		if width != c.expectedWidth || height != c.expectedHeight {
+			t.Errorf("[#%d] Size didn't match! Expected %dx%d, but received %dx%d", index+1, c.expectedWidth, c.expectedHeight, width, height)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 20; y++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	err := Encode(&buf, src, "png", 0)
+	if err != nil {
+		t.Fatalf("Failed to encode image: %s", err)
+	}
+	decoded, format, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to decode image: %s", err)
+	} else if format != "png" {
+		t.Errorf("Format didn't match! Expected png, but received %s", format)
+	}
+
+	thumb := Thumbnail(decoded, 10)
+	if thumb.Bounds().Dx() != 10 || thumb.Bounds().Dy() != 5 {
+		t.Fatalf("Thumbnail size didn't match! Expected 10x5, but received %v", thumb.Bounds())
+	}
+	r, g, b, a := thumb.At(5, 2).RGBA()
+	if r>>8 != 255 || g != 0 || b != 0 || a>>8 != 255 {
+		t.Errorf("Thumbnail color didn't match! Received %d %d %d %d", r>>8, g>>8, b>>8, a>>8)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	cases := []struct {
+		width, height  int
+		fit            string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{100, 100, FitContain, 100, 50},
+		{100, 0, FitContain, 100, 50},
+		{0, 100, FitContain, 200, 100},
+		{100, 100, FitCover, 100, 100},
+		{300, 50, FitCover, 300, 50},
+		{800, 800, FitCover, 400, 200},
+		{100, 100, FitFill, 100, 100},
+		{800, 100, FitFill, 400, 100},
+		{800, 800, FitContain, 400, 200},
+	}
+	for index, c := range cases {
+		bounds := Transform(src, c.width, c.height, c.fit).Bounds()
+		if bounds.Dx() != c.expectedWidth || bounds.Dy() != c.expectedHeight {
+			t.Errorf("[#%d] Size didn't match! Expected %dx%d, but received %dx%d", index+1, c.expectedWidth, c.expectedHeight, bounds.Dx(), bounds.Dy())
+		}
+	}
+}
+
+func TestDimensions(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, image.NewGray(image.Rect(0, 0, 12, 34)), "png", 0)
+	webpHeader := func(chunk string, data ...byte) []byte {
+		header := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), data...)
+		return append(header, make([]byte, 30)...)
+	}
+	cases := []struct {
+		data           []byte
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{buf.Bytes(), 12, 34},
+		{webpHeader("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01), 640, 480},
+		// Width 400 and height 300, i.e. 399 | 299 << 14
+		{webpHeader("VP8L", 0x2f, 0x8f, 0xc1, 0x4a, 0x00), 400, 300},
+		{webpHeader("VP8X", 0, 0, 0, 0, 0x3f, 0x42, 0x0f, 0x0f, 0, 0), 1000000, 16},
+	}
+	for index, c := range cases {
+		width, height, err := Dimensions(bytes.NewReader(c.data))
+		if err != nil {
+			t.Errorf("[#%d] Failed to read dimensions: %s", index+1, err)
+		} else if width != c.expectedWidth || height != c.expectedHeight {
+			t.Errorf("[#%d] Size didn't match! Expected %dx%d, but received %dx%d", index+1, c.expectedWidth, c.expectedHeight, width, height)
+		}
+	}
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)), "png", 0)
+	data := buf.Bytes()
+	// Change the width in the IHDR chunk. The decoder must refuse before reading any pixels.
+	data[16], data[17], data[18], data[19] = 0x7f, 0xff, 0xff, 0xff
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	_, _, err := Decode(bytes.NewReader(data))
+	if err != ErrTooLarge {
+		t.Errorf("Decoding a huge image didn't return ErrTooLarge: %v", err)
+	}
+}
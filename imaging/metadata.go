@@ -0,0 +1,347 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package imaging contains the pure-Go image decoding, resizing and encoding used for thumbnails and resizing.
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidImage is returned by StripMetadata if the image file is malformed.
+var ErrInvalidImage = errors.New("invalid image file")
+
+// CanStripMetadata checks if StripMetadata supports the given format.
+func CanStripMetadata(format string) bool {
+	switch format {
+	case "jpeg", "png", "webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// StripMetadata copies the given image to the given writer without metadata such as EXIF, XMP and text comments.
+// The image data itself is copied as-is without re-encoding. The format must be jpeg, png or webp.
+//
+// The EXIF orientation of JPEG images is kept, as photos would otherwise be shown rotated.
+func StripMetadata(w io.Writer, r io.ReadSeeker, format string) error {
+	_, err := r.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "jpeg":
+		return stripJPEG(w, bufio.NewReader(r))
+	case "png":
+		return stripPNG(w, bufio.NewReader(r))
+	case "webp":
+		return stripWebP(w, r)
+	default:
+		return fmt.Errorf("can't strip metadata from %s images", format)
+	}
+}
+
+// invalidIfEOF converts unexpected ends of files into ErrInvalidImage.
+func invalidIfEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrInvalidImage
+	}
+	return err
+}
+
+const (
+	jpegSOI  = 0xd8
+	jpegSOS  = 0xda
+	jpegAPP1 = 0xe1
+	// APP13 contains Photoshop data, which includes IPTC metadata.
+	jpegAPP13 = 0xed
+	jpegCOM   = 0xfe
+)
+
+func stripJPEG(w io.Writer, r *bufio.Reader) error {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil || header[0] != 0xff || header[1] != jpegSOI {
+		return ErrInvalidImage
+	}
+	_, err = w.Write(header[:])
+	if err != nil {
+		return err
+	}
+	for {
+		marker, err := readJPEGMarker(r)
+		if err != nil {
+			return invalidIfEOF(err)
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd9) {
+			// TEM, RSTn, SOI and EOI don't have any data.
+			_, err = w.Write([]byte{0xff, marker})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var length uint16
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil || length < 2 {
+			return ErrInvalidImage
+		}
+		segment := make([]byte, length-2)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return invalidIfEOF(err)
+		}
+
+		switch marker {
+		case jpegAPP1:
+			// APP1 contains EXIF and XMP data.
+			if orientation := exifOrientation(segment); orientation > 1 {
+				err = writeJPEGSegment(w, jpegAPP1, orientationEXIF(orientation))
+			}
+		case jpegAPP13, jpegCOM:
+		default:
+			err = writeJPEGSegment(w, marker, segment)
+		}
+		if err != nil {
+			return err
+		}
+
+		if marker == jpegSOS {
+			// The compressed image data follows the start of scan segment. There's no metadata after it.
+			_, err = io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+// readJPEGMarker reads the next marker, skipping any fill bytes.
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	} else if b != 0xff {
+		return 0, ErrInvalidImage
+	}
+	for b == 0xff {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+func writeJPEGSegment(w io.Writer, marker byte, data []byte) error {
+	header := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(data)+2))
+	_, err := w.Write(header)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	return err
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// exifOrientation finds the orientation tag from the first IFD of the given APP1 segment.
+// Zero is returned if the segment doesn't contain EXIF data or the orientation tag.
+func exifOrientation(segment []byte) int {
+	if !bytes.HasPrefix(segment, exifHeader) {
+		return 0
+	}
+	tiff := segment[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int64(order.Uint32(tiff[4:]))
+	if offset+2 > int64(len(tiff)) {
+		return 0
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 0
+		}
+		// The orientation tag is a single SHORT, which is stored at the start of the value field.
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
+}
+
+// orientationEXIF creates an EXIF APP1 segment that only contains the given orientation.
+func orientationEXIF(orientation int) []byte {
+	var buf bytes.Buffer
+	buf.Write(exifHeader)
+	// Big-endian TIFF header with the first IFD right after it.
+	buf.Write([]byte{'M', 'M', 0, 42, 0, 0, 0, 8})
+	// One entry: tag 0x0112 (orientation), type 3 (SHORT), count 1 and the value padded to four bytes.
+	buf.Write([]byte{0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0})
+	// No next IFD.
+	buf.Write([]byte{0, 0, 0, 0})
+	return buf.Bytes()
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the PNG chunks that StripMetadata removes.
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true}
+
+func stripPNG(w io.Writer, r *bufio.Reader) error {
+	signature := make([]byte, len(pngSignature))
+	_, err := io.ReadFull(r, signature)
+	if err != nil || !bytes.Equal(signature, pngSignature) {
+		return ErrInvalidImage
+	}
+	_, err = w.Write(signature)
+	if err != nil {
+		return err
+	}
+	for {
+		var header [8]byte
+		_, err = io.ReadFull(r, header[:])
+		if err != nil {
+			return invalidIfEOF(err)
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+		// The chunk data is followed by a 4-byte CRC.
+		if pngMetadataChunks[chunkType] {
+			_, err = r.Discard(int(length + 4))
+			if err != nil {
+				return invalidIfEOF(err)
+			}
+			continue
+		}
+		_, err = w.Write(header[:])
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, r, length+4)
+		if err != nil {
+			return invalidIfEOF(err)
+		} else if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+// webpMetadataChunks are the WebP chunks that StripMetadata removes.
+var webpMetadataChunks = map[string]bool{"EXIF": true, "XMP ": true}
+
+const (
+	webpFlagXMP  = 1 << 2
+	webpFlagEXIF = 1 << 3
+)
+
+type webpChunk struct {
+	fourCC string
+	offset int64
+	size   int64
+}
+
+func stripWebP(w io.Writer, r io.ReadSeeker) error {
+	var header [12]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return ErrInvalidImage
+	}
+	riffEnd := int64(binary.LittleEndian.Uint32(header[4:])) + 8
+
+	// Find the chunks to keep first, as the RIFF header contains the total size.
+	var chunks []webpChunk
+	riffSize := int64(4)
+	offset := int64(len(header))
+	for offset < riffEnd {
+		var chunkHeader [8]byte
+		_, err = io.ReadFull(r, chunkHeader[:])
+		if err != nil {
+			return invalidIfEOF(err)
+		}
+		chunk := webpChunk{
+			fourCC: string(chunkHeader[:4]),
+			offset: offset,
+			size:   int64(binary.LittleEndian.Uint32(chunkHeader[4:])),
+		}
+		// Chunks are padded to an even size.
+		paddedSize := 8 + chunk.size + chunk.size&1
+		if !webpMetadataChunks[chunk.fourCC] {
+			chunks = append(chunks, chunk)
+			riffSize += paddedSize
+		}
+		offset, err = r.Seek(offset+paddedSize, io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	binary.LittleEndian.PutUint32(header[4:], uint32(riffSize))
+	_, err = w.Write(header[:])
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		_, err = r.Seek(chunk.offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		data := io.LimitReader(r, 8+chunk.size+chunk.size&1)
+		var written int64
+		if chunk.fourCC == "VP8X" {
+			// The extended header has flags that tell whether EXIF and XMP chunks exist.
+			var vp8x [9]byte
+			_, err = io.ReadFull(data, vp8x[:])
+			if err != nil {
+				return invalidIfEOF(err)
+			}
+			vp8x[8] &^= webpFlagXMP | webpFlagEXIF
+			_, err = w.Write(vp8x[:])
+			if err != nil {
+				return err
+			}
+			written = int64(len(vp8x))
+		}
+		n, err := io.Copy(w, data)
+		if err != nil {
+			return err
+		} else if written+n < 8+chunk.size {
+			return ErrInvalidImage
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package imaging contains the pure-Go image decoding, resizing and encoding used for thumbnails and resizing.
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"testing"
+)
+
+// littleEndianEXIF is an EXIF segment with the orientation 6 and a fake GPS tag.
+var littleEndianEXIF = append([]byte("Exif\x00\x00II*\x00\x08\x00\x00\x00\x02\x00"+
+	"\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00"+
+	"\x25\x88\x04\x00\x01\x00\x00\x00\x00\x00\x00\x00"+
+	"\x00\x00\x00\x00"), []byte("secretGPS")...)
+
+func TestStripJPEG(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), "jpeg", 0)
+	original := buf.Bytes()
+
+	var withMetadata bytes.Buffer
+	withMetadata.Write(original[:2])
+	writeJPEGSegment(&withMetadata, jpegAPP1, littleEndianEXIF)
+	writeJPEGSegment(&withMetadata, jpegAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00secretXMP"))
+	writeJPEGSegment(&withMetadata, jpegCOM, []byte("secretComment"))
+	withMetadata.Write(original[2:])
+
+	var stripped bytes.Buffer
+	err := StripMetadata(&stripped, bytes.NewReader(withMetadata.Bytes()), "jpeg")
+	if err != nil {
+		t.Fatalf("Failed to strip metadata: %s", err)
+	} else if bytes.Contains(stripped.Bytes(), []byte("secret")) {
+		t.Errorf("Stripped image still contains metadata")
+	}
+	_, _, err = Decode(bytes.NewReader(stripped.Bytes()))
+	if err != nil {
+		t.Errorf("Stripped image can't be decoded: %s", err)
+	}
+
+	// The orientation should be the only thing left in the EXIF data.
+	app1 := stripped.Bytes()[2:]
+	if app1[1] != jpegAPP1 {
+		t.Fatalf("Stripped image doesn't have an EXIF segment")
+	}
+	length := binary.BigEndian.Uint16(app1[2:])
+	if orientation := exifOrientation(app1[4 : 2+length]); orientation != 6 {
+		t.Errorf("Orientation didn't match! Expected 6, but received %d", orientation)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), "png", 0)
+	original := buf.Bytes()
+	// Insert a text chunk before the IEND chunk, which is always the last 12 bytes.
+	text := []byte("tEXtComment\x00secretText")
+	chunk := make([]byte, 4, len(text)+8)
+	binary.BigEndian.PutUint32(chunk, uint32(len(text)-4))
+	chunk = append(chunk, text...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(text))
+	withMetadata := append(append(append([]byte{}, original[:len(original)-12]...), chunk...), original[len(original)-12:]...)
+
+	var stripped bytes.Buffer
+	err := StripMetadata(&stripped, bytes.NewReader(withMetadata), "png")
+	if err != nil {
+		t.Fatalf("Failed to strip metadata: %s", err)
+	} else if !bytes.Equal(stripped.Bytes(), original) {
+		t.Errorf("Stripped image didn't match the original image")
+	}
+
+	err = StripMetadata(&stripped, bytes.NewReader(original[:len(original)-6]), "png")
+	if err != ErrInvalidImage {
+		t.Errorf("Stripping a truncated image didn't return ErrInvalidImage: %v", err)
+	}
+}
+
+func webpChunkBytes(fourCC string, data []byte) []byte {
+	chunk := append([]byte(fourCC), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func TestStripWebP(t *testing.T) {
+	vp8x := []byte{webpFlagEXIF | webpFlagXMP | 0x10, 0, 0, 0, 7, 0, 0, 7, 0, 0}
+	image := webpChunkBytes("VP8L", []byte{0x2f, 7, 0xc0, 1, 0, 1, 2})
+	var body []byte
+	body = append(body, webpChunkBytes("VP8X", vp8x)...)
+	body = append(body, image...)
+	body = append(body, webpChunkBytes("EXIF", []byte("secretEXIF!"))...)
+	body = append(body, webpChunkBytes("XMP ", []byte("secretXMP"))...)
+	file := append([]byte("RIFF\x00\x00\x00\x00WEBP"), body...)
+	binary.LittleEndian.PutUint32(file[4:], uint32(len(body)+4))
+
+	var stripped bytes.Buffer
+	err := StripMetadata(&stripped, bytes.NewReader(file), "webp")
+	if err != nil {
+		t.Fatalf("Failed to strip metadata: %s", err)
+	}
+	result := stripped.Bytes()
+	if bytes.Contains(result, []byte("secret")) {
+		t.Errorf("Stripped image still contains metadata")
+	}
+	if size := binary.LittleEndian.Uint32(result[4:]); int(size) != len(result)-8 {
+		t.Errorf("RIFF size didn't match! Expected %d, but received %d", len(result)-8, size)
+	}
+	if flags := result[20]; flags != 0x10 {
+		t.Errorf("VP8X flags didn't match! Expected 0x10, but received %#x", flags)
+	}
+	if !bytes.HasSuffix(result, image) {
+		t.Errorf("Image data wasn't copied as-is")
+	}
+}
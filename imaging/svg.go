@@ -0,0 +1,151 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package imaging contains the pure-Go image decoding, resizing and encoding used for thumbnails and resizing.
+package imaging
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// IsSVG checks if the given data is an SVG image, i.e. an XML document whose root element is svg.
+// http.DetectContentType doesn't recognize SVG images, as they're just text.
+func IsSVG(r io.Reader) bool {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return false
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			return token.Name.Local == "svg"
+		case xml.CharData:
+			if len(bytes.TrimSpace(token)) > 0 {
+				return false
+			}
+		}
+	}
+}
+
+// svgDangerousElements are the elements that SanitizeSVG removes with all of their content.
+var svgDangerousElements = map[string]bool{
+	"script": true,
+	// foreignObject can contain arbitrary HTML.
+	"foreignObject": true,
+}
+
+// SanitizeSVG copies the given SVG image to the given writer without scripts. Script elements, foreignObject
+// elements, event handler attributes and links to anything other than fragments or embedded images are removed.
+// Comments and doctypes are removed too, as they can define entities.
+func SanitizeSVG(w io.Writer, r io.Reader) error {
+	decoder := xml.NewDecoder(r)
+	var buf bytes.Buffer
+	// skip is the depth of the dangerous element that is being skipped, or zero if nothing is being skipped.
+	depth, skip := 0, 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ErrInvalidImage
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			depth++
+			if skip == 0 && (svgDangerousElements[token.Name.Local] || animatesLink(token)) {
+				skip = depth
+			}
+			if skip == 0 {
+				writeSVGStartElement(&buf, token)
+			}
+		case xml.EndElement:
+			if skip == 0 {
+				buf.WriteString("</" + qualifiedName(token.Name) + ">")
+			} else if skip == depth {
+				skip = 0
+			}
+			depth--
+		case xml.CharData:
+			if skip == 0 {
+				xml.EscapeText(&buf, token)
+			}
+		case xml.ProcInst:
+			if token.Target == "xml" {
+				buf.WriteString("<?xml " + string(token.Inst) + "?>")
+			}
+		}
+		if buf.Len() > 32*1024 {
+			_, err = buf.WriteTo(w)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if depth != 0 {
+		return ErrInvalidImage
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// animatesLink checks if the given element is an animation that changes a link, which can be used to inject a
+// javascript: URL after sanitization.
+func animatesLink(element xml.StartElement) bool {
+	switch element.Name.Local {
+	case "animate", "set":
+		for _, attr := range element.Attr {
+			if attr.Name.Local == "attributeName" && strings.HasSuffix(strings.ToLower(attr.Value), "href") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeSVGStartElement(buf *bytes.Buffer, element xml.StartElement) {
+	buf.WriteString("<" + qualifiedName(element.Name))
+	for _, attr := range element.Attr {
+		name := strings.ToLower(attr.Name.Local)
+		if strings.HasPrefix(name, "on") || (name == "href" && !safeSVGLink(attr.Value)) {
+			continue
+		}
+		buf.WriteString(" " + qualifiedName(attr.Name) + "=\"")
+		xml.EscapeText(buf, []byte(attr.Value))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('>')
+}
+
+// safeSVGLink checks if the given link points to a fragment of the same document or an embedded raster image.
+func safeSVGLink(link string) bool {
+	link = strings.ToLower(strings.TrimSpace(link))
+	return strings.HasPrefix(link, "#") || strings.HasPrefix(link, "data:image/png") ||
+		strings.HasPrefix(link, "data:image/jpeg") || strings.HasPrefix(link, "data:image/gif")
+}
+
+// qualifiedName returns the name as it was in the document. RawToken doesn't resolve namespaces, so the prefix is
+// stored in Name.Space.
+func qualifiedName(name xml.Name) string {
+	if len(name.Space) > 0 {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
@@ -0,0 +1,68 @@
+// mauImageServer - A self-hosted server to store and easily share images.
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package imaging contains the pure-Go image decoding, resizing and encoding used for thumbnails and resizing.
+package imaging
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIsSVG(t *testing.T) {
+	cases := map[string]bool{
+		`<svg xmlns="http://www.w3.org/2000/svg"/>`:                              true,
+		"<?xml version=\"1.0\"?>\n<!-- comment -->\n<!DOCTYPE svg>\n<svg></svg>": true,
+		`<html><svg></svg></html>`:                                               false,
+		`not xml`:                                                                false,
+		"\x89PNG\r\n\x1a\n":                                                      false,
+	}
+	for data, expected := range cases {
+		if IsSVG(strings.NewReader(data)) != expected {
+			t.Errorf("IsSVG(%q) should've returned %t", data, expected)
+		}
+	}
+}
+
+func TestSanitizeSVG(t *testing.T) {
+	svg := `<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY x "secret">]>` +
+		`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" onload="secret()">` +
+		`<script>secret()</script><foreignObject><div>secret</div></foreignObject>` +
+		`<a xlink:href="javascript:secret()"><rect width="10" height="10" onclick="secret()"/></a>` +
+		`<a href="#fragment"><set attributeName="href" to="javascript:secret()"/></a>` +
+		`<style>rect > a { fill: red }</style></svg>`
+	var buf bytes.Buffer
+	err := SanitizeSVG(&buf, strings.NewReader(svg))
+	if err != nil {
+		t.Fatalf("Failed to sanitize SVG: %s", err)
+	}
+	expected := `<?xml version="1.0"?>` +
+		`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">` +
+		`<a><rect width="10" height="10"></rect></a><a href="#fragment"></a>` +
+		`<style>rect &gt; a { fill: red }</style></svg>`
+	if buf.String() != expected {
+		t.Errorf("Sanitized SVG didn't match!\nExpected %s\nbut received %s", expected, buf.String())
+	}
+	if !IsSVG(&buf) {
+		t.Errorf("Sanitized SVG is not valid")
+	}
+
+	err = SanitizeSVG(&buf, strings.NewReader(`<svg><g></svg>`))
+	if err != ErrInvalidImage {
+		t.Errorf("Sanitizing a malformed SVG didn't return ErrInvalidImage: %v", err)
+	}
+}
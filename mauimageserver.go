@@ -18,6 +18,8 @@ package main
 import (
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 	flag "github.com/ogier/pflag"
 	"maunium.net/go/mauimageserver/data"
 	"maunium.net/go/mauimageserver/handlers"
@@ -37,9 +39,11 @@ var debug = flag.BoolP("debug", "d", false, "Enable to print debug messages to s
 var confPath = flag.StringP("config", "c", "/etc/mis/config.json", "The path of the mauImageServer configuration file.")
 var logPath = flag.StringP("logs", "l", "/var/log/mis", "The path of the mauImageServer configuration file.")
 var disableSafeShutdown = flag.Bool("no-safe-shutdown", false, "Disable Interrupt/SIGTERM catching and handling.")
+var migrateOnly = flag.Bool("migrate-only", false, "Upgrade the database schema and exit without starting the server.")
 
 var config *data.Configuration
 var database data.MISDatabase
+var store data.ImageStore
 var auth mauth.System
 
 func main() {
@@ -71,18 +75,37 @@ func main() {
 	log.Infof("Initializing mauImageServer " + version)
 	loadConfig()
 	loadDatabase()
+	if *migrateOnly {
+		log.Infof("Database schema is up to date, exiting")
+		database.Unload()
+		return
+	}
+	loadStore()
 	loadTemplates()
 
-	handlers.Init(config, database, auth)
+	handlers.Init(config, database, store, auth)
+	go handlers.ExpireUploads()
+	go handlers.ExpireImages()
+	go handlers.PurgeTrash()
 
 	log.Infof("Registering handlers")
-	http.HandleFunc("/auth/login", handlers.Login)
-	http.HandleFunc("/auth/register", handlers.Register)
-	http.HandleFunc("/insert", handlers.Insert)
-	http.HandleFunc("/delete", handlers.Delete)
-	http.HandleFunc("/hide", handlers.Hide)
-	http.HandleFunc("/search", handlers.Search)
-	http.HandleFunc("/", handlers.Get)
+	http.HandleFunc("/auth/login", handlers.CORS("POST", handlers.Login))
+	http.HandleFunc("/auth/register", handlers.CORS("POST", handlers.Register))
+	http.HandleFunc("/insert", handlers.CORS("POST, PUT", handlers.Insert))
+	http.HandleFunc("/insert/", handlers.CORS("POST, PUT", handlers.Insert))
+	http.HandleFunc("/upload", handlers.CORS("POST", handlers.Upload))
+	http.HandleFunc("/upload/", handlers.CORS("HEAD, PATCH, DELETE", handlers.Upload))
+	http.HandleFunc("/delete", handlers.CORS("POST", handlers.Delete))
+	http.HandleFunc("/trash", handlers.CORS("POST", handlers.Trash))
+	http.HandleFunc("/restore", handlers.CORS("POST", handlers.Restore))
+	http.HandleFunc("/hide", handlers.CORS("POST", handlers.Hide))
+	http.HandleFunc("/sign", handlers.CORS("POST", handlers.Sign))
+	http.HandleFunc("/unlock/", handlers.CORS("POST", handlers.Unlock))
+	http.HandleFunc("/search", handlers.CORS("POST", handlers.Search))
+	http.HandleFunc("/thumb/", handlers.CORS("GET, HEAD", handlers.Thumbnail))
+	http.HandleFunc("/api/images/", handlers.CORS("GET, HEAD", handlers.ImageInfo))
+	http.HandleFunc("/oembed", handlers.CORS("GET, HEAD", handlers.OEmbed))
+	http.HandleFunc("/", handlers.CORS("GET, HEAD", handlers.Get))
 	log.Infof("Listening on %s:%d", config.IP, config.Port)
 	http.ListenAndServe(config.IP+":"+strconv.Itoa(config.Port), nil)
 }
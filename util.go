@@ -52,6 +52,17 @@ func loadDatabase() {
 	log.Debugln("Successfully loaded database.")
 }
 
+func loadStore() {
+	log.Infof("Loading image store...")
+	var err error
+	store, err = data.CreateImageStore(config)
+	if err != nil {
+		log.Fatalf("Failed to load image store: %[1]s", err)
+		os.Exit(4)
+	}
+	log.Debugln("Successfully loaded image store.")
+}
+
 func loadTemplates() {
 	log.Infof("Loading HTML templates...")
 	err := data.LoadTemplates(config.ImageTemplate)